@@ -0,0 +1,171 @@
+package mysql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/rubblelabs/ripple/data"
+	"strings"
+)
+
+// MySQL refuses prepared statements with more placeholders than this
+const maxPlaceholders = 65535
+
+// Execer runs a statement. The Execer passed to a TransactionHandler
+// may batch rows or check them for conflicts rather than run them.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type queryer interface {
+	Execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// batch collects the rows of single row INSERT/REPLACE statements
+// so that they can be written as multi-row statements.
+type batch struct {
+	order []string
+	rows  map[string][][]interface{}
+}
+
+func newBatch() *batch {
+	return &batch{
+		rows: make(map[string][][]interface{}),
+	}
+}
+
+// Exec queues a row. Nothing is written until Flush, so the result
+// reports no affected rows.
+func (b *batch) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if _, ok := b.rows[query]; !ok {
+		b.order = append(b.order, query)
+	}
+	b.rows[query] = append(b.rows[query], args)
+	return driver.RowsAffected(0), nil
+}
+
+func (b *batch) Flush(tx Execer) error {
+	for _, query := range b.order {
+		rows := b.rows[query]
+		size := maxPlaceholders / len(rows[0])
+		for len(rows) > 0 {
+			n := len(rows)
+			if n > size {
+				n = size
+			}
+			stmnt, err := multiRow(query, n)
+			if err != nil {
+				return err
+			}
+			var args []interface{}
+			for _, row := range rows[:n] {
+				args = append(args, row...)
+			}
+			if _, err := tx.Exec(stmnt, args...); err != nil {
+				return fmt.Errorf("%s\n%s", err, query)
+			}
+			rows = rows[n:]
+		}
+	}
+	b.order, b.rows = nil, make(map[string][][]interface{})
+	return nil
+}
+
+// multiRow repeats the value tuple of query n times, keeping any clause
+// that follows it.
+func multiRow(query string, n int) (string, error) {
+	i := strings.Index(strings.ToUpper(query), "VALUES")
+	if i < 0 {
+		return "", fmt.Errorf("Cannot batch statement: %s", query)
+	}
+	start := strings.Index(query[i:], "(")
+	if start < 0 {
+		return "", fmt.Errorf("Cannot batch statement: %s", query)
+	}
+	start += i
+	end, depth := -1, 0
+	for j := start; j < len(query) && end < 0; j++ {
+		switch query[j] {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				end = j + 1
+			}
+		}
+	}
+	if end < 0 {
+		return "", fmt.Errorf("Cannot batch statement: %s", query)
+	}
+	tuples := make([]string, n)
+	for j := range tuples {
+		tuples[j] = query[start:end]
+	}
+	return query[:start] + strings.Join(tuples, ",") + query[end:], nil
+}
+
+func (db *sqldb) InsertBatch(items []data.Storer) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if err := db.ensureBatchPartitions(items); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	lookups := db.lookupTx(tx)
+	if err := db.insertBatch(items, tx, lookups); err != nil {
+		return lookups.rollback(err)
+	}
+	return lookups.commit()
+}
+
+func (db *sqldb) ensureBatchPartitions(items []data.Storer) error {
+	var max uint32
+	for _, item := range items {
+		if seq := ledgerSequence(item); seq > max {
+			max = seq
+		}
+	}
+	return db.ensurePartitions(max)
+}
+
+func (db *sqldb) insertBatch(items []data.Storer, tx *sql.Tx, lookups Lookuper) error {
+	var (
+		b       = newBatch()
+		w       Execer
+		mode    = db.insertMode()
+		ledgers []*data.Ledger
+		txs     = make(map[uint32][]*data.TransactionWithMetaData)
+	)
+	// Conflicts can only be detected row by row
+	if w = b; mode != InsertReplace {
+		w = db.newWriter(tx, mode)
+	}
+	for _, item := range ledgersFirst(items) {
+		if err := db.prepare(item, tx); err != nil {
+			return err
+		}
+		if err := db.insert(item, w, lookups); err != nil {
+			return err
+		}
+		switch v := item.(type) {
+		case *data.Ledger:
+			ledgers = append(ledgers, v)
+		case *data.TransactionWithMetaData:
+			txs[v.LedgerSequence] = append(txs[v.LedgerSequence], v)
+		}
+	}
+	if err := b.Flush(tx); err != nil {
+		return err
+	}
+	for _, ledger := range ledgers {
+		if _, err := db.completeLedger(ledger, txs[ledger.LedgerSequence], tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+//go:build boxedlookup
+// +build boxedlookup
+
+package mysql
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/rubblelabs/ripple/storage"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// boxedCache is the interface keyed lookupCache that the typed caches
+// replaced. This file keeps a copy of the reflect based lookup so that
+// the two can be compared with
+//
+//	go test -tags boxedlookup -run XXX -bench 'Lookup|Get'
+type boxedCache interface {
+	id(key interface{}) (uint32, bool)
+	value(id uint32) (interface{}, bool)
+	add(key interface{}, id uint32)
+}
+
+type boxedMapCache struct {
+	mu sync.RWMutex
+	m  map[interface{}]uint32
+	r  map[uint32]interface{}
+}
+
+func newBoxedMapCache() *boxedMapCache {
+	return &boxedMapCache{
+		m: make(map[interface{}]uint32),
+		r: make(map[uint32]interface{}),
+	}
+}
+
+func (c *boxedMapCache) id(key interface{}) (uint32, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.m[key]
+	return id, ok
+}
+
+func (c *boxedMapCache) value(id uint32) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.r[id]
+	return v, ok
+}
+
+func (c *boxedMapCache) add(key interface{}, id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = id
+	c.r[id] = key
+}
+
+type boxedLRUCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	m     map[interface{}]*list.Element
+	r     map[uint32]*list.Element
+}
+
+type boxedLRUEntry struct {
+	key interface{}
+	id  uint32
+}
+
+func newBoxedLRUCache(size int) *boxedLRUCache {
+	if size <= 0 {
+		size = defaultLookupCacheSize
+	}
+	return &boxedLRUCache{
+		size:  size,
+		order: list.New(),
+		m:     make(map[interface{}]*list.Element),
+		r:     make(map[uint32]*list.Element),
+	}
+}
+
+func (c *boxedLRUCache) id(key interface{}) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return 0, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*boxedLRUEntry).id, true
+}
+
+func (c *boxedLRUCache) value(id uint32) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.r[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*boxedLRUEntry).key, true
+}
+
+func (c *boxedLRUCache) add(key interface{}, id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.m[key] = c.order.PushFront(&boxedLRUEntry{key, id})
+	c.r[id] = c.m[key]
+	for c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Back()).(*boxedLRUEntry)
+		delete(c.m, oldest.key)
+		delete(c.r, oldest.id)
+	}
+}
+
+type boxedLookup struct {
+	cache   boxedCache
+	bounded bool
+	db      lookupDB
+	stmnts  lookupStatements
+	typ     reflect.Type
+	seed    interface{}
+	once    sync.Once
+	err     error
+}
+
+func newBoxedLookup(stmnts lookupStatements, db lookupDB, typ reflect.Type, seed interface{}, policy LookupCachePolicy, size int) (*boxedLookup, error) {
+	l := &boxedLookup{
+		db:     db,
+		stmnts: stmnts,
+		typ:    typ,
+		seed:   seed,
+	}
+	switch policy {
+	case LookupCacheBounded:
+		l.cache, l.bounded = newBoxedLRUCache(size), true
+	default:
+		l.cache = newBoxedMapCache()
+	}
+	if policy == LookupCacheLazy {
+		return l, nil
+	}
+	return l, l.load()
+}
+
+func (l *boxedLookup) load() error {
+	l.once.Do(func() { l.err = l.fill() })
+	return l.err
+}
+
+func (l *boxedLookup) fill() error {
+	if !l.bounded {
+		items, err := l.db.GetLookups(l.stmnts.All)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			l.cache.add(l.value(item.Value), item.Id)
+		}
+	}
+	if l.seed == nil {
+		return nil
+	}
+	if _, err := l.resolve(l.seed); err != nil && err != ErrReadOnly {
+		return err
+	}
+	return nil
+}
+
+func (l *boxedLookup) value(b interface{}) interface{} {
+	v := reflect.New(l.typ).Elem()
+	reflect.Copy(v, reflect.ValueOf(b))
+	return v.Interface()
+}
+
+func (l *boxedLookup) find(key interface{}, item *LookupItem) (uint32, bool, error) {
+	if id, ok := l.cache.id(key); ok || !l.bounded {
+		return id, ok, nil
+	}
+	switch err := l.db.GetLookupIdContext(context.Background(), l.stmnts.Id, item); err {
+	case nil:
+		l.cache.add(key, item.Id)
+		return item.Id, true, nil
+	case storage.ErrNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, err
+	}
+}
+
+func (l *boxedLookup) get(n uint32) interface{} {
+	if l.load() != nil {
+		return nil
+	}
+	if v, ok := l.cache.value(n); ok || !l.bounded {
+		return v
+	}
+	item := &LookupItem{Id: n}
+	if err := l.db.GetLookupValue(l.stmnts.Value, item); err != nil {
+		return nil
+	}
+	v := l.value(item.Value)
+	l.cache.add(v, n)
+	return v
+}
+
+func (l *boxedLookup) Lookup(value interface{}) (uint32, error) {
+	if err := l.load(); err != nil {
+		return 0, err
+	}
+	return l.resolve(value)
+}
+
+func (l *boxedLookup) resolve(value interface{}) (uint32, error) {
+	key, item := l.item(value)
+	if id, ok, err := l.find(key, item); ok || err != nil {
+		return id, err
+	}
+	if err := l.db.InsertLookup(l.stmnts.Insert, item); err != nil {
+		return 0, err
+	}
+	l.cache.add(key, item.Id)
+	return item.Id, nil
+}
+
+func (l *boxedLookup) item(value interface{}) (interface{}, *LookupItem) {
+	v := reflect.Indirect(reflect.ValueOf(value))
+	return v.Interface(), &LookupItem{
+		Value: v.Slice(0, v.Len()).Interface(),
+		Human: value.(fmt.Stringer).String(),
+	}
+}
+
+func newBoxedAddressLookup(db lookupDB, policy LookupCachePolicy, size int) (*boxedLookup, error) {
+	var accountZero data.Account
+	return newBoxedLookup(lookupStatements{
+		All:    "GetAccounts",
+		Insert: "InsertAccount",
+		Id:     "GetAccountId",
+		Value:  "GetAccount",
+		Values: "GetAccountsById",
+	}, db, reflect.TypeOf(accountZero), &accountZero, policy, size)
+}
+
+func benchmarkBoxedLookup(b *testing.B, policy LookupCachePolicy, size int) {
+	accounts := benchmarkAccountList()
+	db := newBenchmarkDB(accounts)
+	var l *boxedLookup
+	reportHeap(b, func() {
+		var err error
+		if l, err = newBoxedAddressLookup(db, policy, size); err != nil {
+			b.Fatal(err)
+		}
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Lookup(&accounts[i%len(accounts)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBoxedLookupFull(b *testing.B) {
+	benchmarkBoxedLookup(b, LookupCacheFull, 0)
+}
+
+func BenchmarkBoxedLookupBounded(b *testing.B) {
+	benchmarkBoxedLookup(b, LookupCacheBounded, benchmarkAccounts)
+}
+
+func BenchmarkBoxedGetFull(b *testing.B) {
+	accounts := benchmarkAccountList()
+	db := newBenchmarkDB(accounts)
+	var l *boxedLookup
+	reportHeap(b, func() {
+		var err error
+		if l, err = newBoxedAddressLookup(db, LookupCacheFull, 0); err != nil {
+			b.Fatal(err)
+		}
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if l.get(uint32(i%len(accounts))) == nil {
+			b.Fatal("missing account")
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package mysql
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/rubblelabs/ripple/data"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const bulkFlushSize = 64 << 20
+
+var bulkLoads uint64
+
+type secondaryIndex struct {
+	Table, Name, Columns string
+}
+
+// secondaryIndexes are dropped for the duration of a bulk load.
+// Names are those MySQL assigns to the unnamed keys in schema.
+var secondaryIndexes = []secondaryIndex{
+	{"Ledger", "Hash", "Hash"},
+	{"Transaction", "Hash", "Hash"},
+	{"Transaction", "Account", "Account,TransactionType"},
+	{"Transaction", "TransactionType", "TransactionType"},
+	{"Payment", "Destination", "Destination"},
+	{"AccountRoot", "Account", "Account"},
+}
+
+// BulkLoader writes ledgers and transactions as tab separated streams,
+// one per table, and loads them with LOAD DATA LOCAL INFILE. The server
+// must have local_infile enabled. Secondary indexes are dropped until
+// Close is called. Lookup values are inserted in a transaction that
+// Flush commits along with the rows that use them.
+type BulkLoader struct {
+	db      *sqldb
+	lookups *lookupTx
+	tables  map[string]*bytes.Buffer
+	size    int
+	ledgers []*data.Ledger
+	txs     map[uint32][]*data.TransactionWithMetaData
+	// flushSize is the number of buffered bytes that triggers a Flush
+	flushSize int
+}
+
+func NewBulkLoader(db IndexedDB) (*BulkLoader, error) {
+	inner, ok := db.(*sqldb)
+	if !ok {
+		return nil, fmt.Errorf("Cannot bulk load into %T", db)
+	}
+	b := &BulkLoader{
+		db:        inner,
+		tables:    make(map[string]*bytes.Buffer),
+		txs:       make(map[uint32][]*data.TransactionWithMetaData),
+		flushSize: bulkFlushSize,
+	}
+	for _, index := range secondaryIndexes {
+		exists, err := b.indexExists(index)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		if _, err := inner.Exec(fmt.Sprintf("ALTER TABLE %s DROP INDEX %s;", index.Table, index.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *BulkLoader) indexExists(index secondaryIndex) (bool, error) {
+	var n int
+	err := b.db.QueryRow(`SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND INDEX_NAME=?;`, b.db.prefix+index.Table, index.Name).Scan(&n)
+	return n > 0, err
+}
+
+func (b *BulkLoader) Insert(v data.Storer) error {
+	if err := b.db.ensurePartitions(ledgerSequence(v)); err != nil {
+		return err
+	}
+	lookups, err := b.lookupTx()
+	if err != nil {
+		return err
+	}
+	if err := b.db.insert(v, b, lookups); err != nil {
+		return err
+	}
+	switch item := v.(type) {
+	case *data.Ledger:
+		b.ledgers = append(b.ledgers, item)
+	case *data.TransactionWithMetaData:
+		b.txs[item.LedgerSequence] = append(b.txs[item.LedgerSequence], item)
+	}
+	if b.size >= b.flushSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+// lookupTx returns the transaction of the current flush
+func (b *BulkLoader) lookupTx() (*lookupTx, error) {
+	if b.lookups == nil {
+		tx, err := b.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		b.lookups = b.db.lookupTx(tx)
+	}
+	return b.lookups, nil
+}
+
+func (b *BulkLoader) Exec(query string, args ...interface{}) (sql.Result, error) {
+	fields := strings.Fields(query)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("Cannot bulk load statement: %s", query)
+	}
+	table := strings.TrimSuffix(fields[2], "(")
+	buf, ok := b.tables[table]
+	if !ok {
+		buf = new(bytes.Buffer)
+		b.tables[table] = buf
+	}
+	before := buf.Len()
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteByte('\t')
+		}
+		if err := writeField(buf, arg); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('\n')
+	b.size += buf.Len() - before
+	// Rows are only loaded by Flush
+	return driver.RowsAffected(0), nil
+}
+
+// Flush loads every buffered row and marks the loaded ledgers complete
+// where their transactions verify. Ledgers that do not, and
+// transactions whose ledger has not been inserted, are kept and checked
+// again by later flushes. If Flush fails the rows buffered since the
+// last Flush are discarded, with the lookup values they used, and must
+// be inserted again.
+func (b *BulkLoader) Flush() error {
+	lookups, err := b.lookupTx()
+	if err != nil {
+		return err
+	}
+	tables := b.tables
+	b.lookups, b.tables, b.size = nil, make(map[string]*bytes.Buffer), 0
+	tx := lookups.tx
+	for table, buf := range tables {
+		if err := b.load(tx, table, buf); err != nil {
+			return lookups.rollback(err)
+		}
+	}
+	// A flush can fall in the middle of a ledger, so ledgers that do not
+	// verify yet are checked again with the transactions of later flushes.
+	var incomplete []*data.Ledger
+	for _, ledger := range b.ledgers {
+		complete, err := b.db.completeLedger(ledger, b.txs[ledger.LedgerSequence], tx)
+		switch {
+		case err != nil:
+			return lookups.rollback(err)
+		case complete:
+			delete(b.txs, ledger.LedgerSequence)
+		default:
+			incomplete = append(incomplete, ledger)
+		}
+	}
+	if err := lookups.commit(); err != nil {
+		return err
+	}
+	b.ledgers = incomplete
+	return nil
+}
+
+func (b *BulkLoader) load(tx *sql.Tx, table string, buf *bytes.Buffer) error {
+	name := fmt.Sprintf("%s_%d", table, atomic.AddUint64(&bulkLoads, 1))
+	gomysql.RegisterReaderHandler(name, func() io.Reader { return buf })
+	defer gomysql.DeregisterReaderHandler(name)
+	// The streams hold raw binary values, which must not be read as
+	// text in the database's character set
+	stmnt := fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s' REPLACE INTO TABLE %s CHARACTER SET binary;", name, table)
+	if _, err := tx.Exec(stmnt); err != nil {
+		return fmt.Errorf("%s\n%s", err, stmnt)
+	}
+	// LOAD DATA only warns of values it truncates or converts
+	var (
+		level, message string
+		code           int
+	)
+	switch err := tx.QueryRow(`SHOW WARNINGS LIMIT 1;`).Scan(&level, &code, &message); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+		return fmt.Errorf("%s %d: %s\n%s", level, code, message, stmnt)
+	default:
+		return err
+	}
+}
+
+// Close flushes remaining rows and rebuilds the secondary indexes.
+func (b *BulkLoader) Close() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	for _, index := range secondaryIndexes {
+		exists, err := b.indexExists(index)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := b.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD INDEX %s(%s);", index.Table, index.Name, index.Columns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// datetimeLayout is the text form of DATETIME values
+const datetimeLayout = "2006-01-02 15:04:05.999999"
+
+var fieldEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\t", "\\t",
+	"\n", "\\n",
+	"\r", "\\r",
+	"\x00", "\\0",
+)
+
+func writeField(buf *bytes.Buffer, arg interface{}) error {
+	text, err := fieldText(arg)
+	switch {
+	case err != nil:
+		return err
+	case text == nil:
+		buf.WriteString("\\N")
+	default:
+		fieldEscaper.WriteString(buf, string(text))
+	}
+	return nil
+}
+
+// fieldText renders a statement argument in the text form MySQL uses
+// for it. NULL is nil.
+func fieldText(arg interface{}) ([]byte, error) {
+	if valuer, ok := arg.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return nil, err
+		}
+		arg = v
+	}
+	v, err := driver.DefaultParameterConverter.ConvertValue(arg)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		if v == nil {
+			return nil, nil
+		}
+		return append([]byte{}, v...), nil
+	case string:
+		return []byte(v), nil
+	case int64:
+		return strconv.AppendInt(nil, v, 10), nil
+	case uint64:
+		return strconv.AppendUint(nil, v, 10), nil
+	case float64:
+		return strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return []byte("1"), nil
+		}
+		return []byte("0"), nil
+	case time.Time:
+		return []byte(v.Format(datetimeLayout)), nil
+	default:
+		return nil, fmt.Errorf("Cannot convert %+v", v)
+	}
+}
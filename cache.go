@@ -0,0 +1,115 @@
+package mysql
+
+import (
+	"container/list"
+	"sync"
+)
+
+const defaultLookupCacheSize = 100000
+
+// lookupCache maps the values of a lookup table to their Ids and back
+type lookupCache[K comparable] interface {
+	id(key K) (uint32, bool)
+	value(id uint32) (K, bool)
+	add(key K, id uint32)
+}
+
+// mapCache holds every row it is given
+type mapCache[K comparable] struct {
+	mu sync.RWMutex
+	m  map[K]uint32
+	r  map[uint32]K
+}
+
+func newMapCache[K comparable]() *mapCache[K] {
+	return &mapCache[K]{
+		m: make(map[K]uint32),
+		r: make(map[uint32]K),
+	}
+}
+
+func (c *mapCache[K]) id(key K) (uint32, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.m[key]
+	return id, ok
+}
+
+func (c *mapCache[K]) value(id uint32) (K, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.r[id]
+	return v, ok
+}
+
+func (c *mapCache[K]) add(key K, id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = id
+	c.r[id] = key
+}
+
+// lruCache holds at most size rows, evicting the least recently used
+type lruCache[K comparable] struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	m     map[K]*list.Element
+	r     map[uint32]*list.Element
+}
+
+type lruEntry[K comparable] struct {
+	key K
+	id  uint32
+}
+
+func newLRUCache[K comparable](size int) *lruCache[K] {
+	if size <= 0 {
+		size = defaultLookupCacheSize
+	}
+	return &lruCache[K]{
+		size:  size,
+		order: list.New(),
+		m:     make(map[K]*list.Element),
+		r:     make(map[uint32]*list.Element),
+	}
+}
+
+func (c *lruCache[K]) id(key K) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return 0, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K]).id, true
+}
+
+func (c *lruCache[K]) value(id uint32) (K, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.r[id]
+	if !ok {
+		var zero K
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K]).key, true
+}
+
+func (c *lruCache[K]) add(key K, id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.m[key] = c.order.PushFront(&lruEntry[K]{key, id})
+	c.r[id] = c.m[key]
+	for c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Back()).(*lruEntry[K])
+		delete(c.m, oldest.key)
+		delete(c.r, oldest.id)
+	}
+}
@@ -0,0 +1,155 @@
+package mysql
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/rubblelabs/ripple/storage"
+	"runtime"
+	"testing"
+)
+
+const benchmarkAccounts = 100000
+
+// stubLookupDB serves lookup rows from memory
+type stubLookupDB struct {
+	items []LookupItem
+	ids   map[string]uint32
+	finds int
+}
+
+func (s *stubLookupDB) InsertLookup(stmnt string, item *LookupItem) error {
+	item.Id = uint32(len(s.items))
+	s.items = append(s.items, *item)
+	s.ids[string(item.Value.([]byte))] = item.Id
+	return nil
+}
+
+func (s *stubLookupDB) GetLookups(string, ...interface{}) ([]LookupItem, error) {
+	return s.items, nil
+}
+
+func (s *stubLookupDB) GetLookupIdContext(ctx context.Context, stmnt string, item *LookupItem) error {
+	s.finds++
+	id, ok := s.ids[string(item.Value.([]byte))]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	item.Id = id
+	return nil
+}
+
+func (s *stubLookupDB) GetLookupValue(stmnt string, item *LookupItem) error {
+	if int(item.Id) >= len(s.items) {
+		return storage.ErrNotFound
+	}
+	*item = s.items[item.Id]
+	return nil
+}
+
+func (s *stubLookupDB) GetLookupValues(stmnt string, ids []uint32) ([]LookupItem, error) {
+	var items []LookupItem
+	for _, id := range ids {
+		if int(id) < len(s.items) {
+			items = append(items, s.items[id])
+		}
+	}
+	return items, nil
+}
+
+func TestPendingLookups(t *testing.T) {
+	db := &stubLookupDB{ids: make(map[string]uint32)}
+	l, err := newAddressLookup(db, lookupConfig{policy: LookupCacheBounded, size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var account data.Account
+	account[0] = 1
+	tx := &lookupTx{accounts: map[data.Account]uint32{account: 7}}
+	finds := db.finds
+	id, err := resolveTx(tx, l.lookup, tx.accounts, &account)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case id != 7:
+		t.Fatalf("Resolved pending account to %d", id)
+	case db.finds != finds:
+		t.Fatal("Pending account was read from the database")
+	}
+}
+
+func benchmarkAccountList() []data.Account {
+	accounts := make([]data.Account, benchmarkAccounts)
+	for i := range accounts {
+		binary.BigEndian.PutUint32(accounts[i][:], uint32(i))
+	}
+	return accounts
+}
+
+func newBenchmarkDB(accounts []data.Account) *stubLookupDB {
+	db := &stubLookupDB{ids: make(map[string]uint32)}
+	for i := range accounts {
+		db.InsertLookup("InsertAccount", &LookupItem{
+			Value: accounts[i][:],
+			Human: accounts[i].String(),
+		})
+	}
+	return db
+}
+
+// reportHeap reports the heap retained by the values that load creates
+func reportHeap(b *testing.B, load func()) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	load()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc)-float64(before.HeapAlloc), "heap-B")
+}
+
+func benchmarkLookup(b *testing.B, policy LookupCachePolicy, size int) {
+	accounts := benchmarkAccountList()
+	db := newBenchmarkDB(accounts)
+	var l *AccountLookup
+	reportHeap(b, func() {
+		var err error
+		if l, err = newAddressLookup(db, lookupConfig{policy: policy, size: size}); err != nil {
+			b.Fatal(err)
+		}
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Lookup(&accounts[i%len(accounts)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupFull(b *testing.B) {
+	benchmarkLookup(b, LookupCacheFull, 0)
+}
+
+func BenchmarkLookupBounded(b *testing.B) {
+	benchmarkLookup(b, LookupCacheBounded, benchmarkAccounts)
+}
+
+func BenchmarkGetFull(b *testing.B) {
+	accounts := benchmarkAccountList()
+	db := newBenchmarkDB(accounts)
+	var l *AccountLookup
+	reportHeap(b, func() {
+		var err error
+		if l, err = newAddressLookup(db, lookupConfig{}); err != nil {
+			b.Fatal(err)
+		}
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if l.Get(uint32(i%len(accounts))) == nil {
+			b.Fatal("missing account")
+		}
+	}
+}
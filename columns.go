@@ -1,9 +1,12 @@
 package mysql
 
 import (
+	"database/sql"
 	"github.com/rubblelabs/ripple/data"
 )
 
+const ledgerColumns = `LedgerSequence,TotalXRP,PreviousLedger,TransactionHash,StateHash,ParentCloseTime,CloseTime,CloseResolution,CloseFlags,Hash`
+
 func LedgerColumns(ledger *data.Ledger) []interface{} {
 	return []interface{}{
 		&ledger.LedgerSequence,
@@ -38,55 +41,316 @@ func TxmColumns(txm *TransactionRow) []interface{} {
 		&base.TxnSignature,
 		&Hash256{&base.Hash},
 	}
-	switch v := txm.Transaction.(type) {
-	case *data.Payment:
-		items = append(items,
-			&Account{&v.Destination, nil},
-			NewAmount(&v.Amount),
-			&NullAmount{&txm.MetaData.DeliveredAmount},
-			&NullAmount{&v.SendMax},
-			&NullUint32{&v.DestinationTag},
-			&NullHash256{&v.InvoiceID},
-		)
-	case *data.OfferCreate:
-		items = append(items,
-			&NullUint32{&v.OfferSequence},
-			NewAmount(&v.TakerPays),
-			NewAmount(&v.TakerGets),
-			&NullUint32{&v.Expiration},
-		)
-	case *data.OfferCancel:
-		items = append(items,
-			&v.OfferSequence,
-		)
-	case *data.AccountSet:
-		items = append(items,
-			&NullHash128{&v.EmailHash},
-			&NullHash256{&v.WalletLocator},
-			&NullUint32{&v.WalletSize},
-			&v.MessageKey,
-			&v.Domain,
-			&NullUint32{&v.TransferRate},
-			&NullUint32{&v.SetFlag},
-			&NullUint32{&v.ClearFlag},
-		)
-	case *data.TrustSet:
-		items = append(items,
-			NewAmount(&v.LimitAmount),
-			&NullUint32{&v.QualityIn},
-			&NullUint32{&v.QualityOut},
-		)
-	case *data.SetRegularKey:
-		items = append(items,
-			&NullRegularKey{&v.RegularKey},
-		)
-	case *data.SetFee:
-		items = append(items,
-			&v.BaseFee,
-			&v.ReferenceFeeUnits,
-			&v.ReserveBase,
-			&v.ReserveIncrement,
-		)
+	if handler, err := transactionHandler(base.TransactionType); err == nil {
+		items = append(items, handler.Columns(txm)...)
 	}
 	return items
 }
+
+func paymentColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.Payment)
+	return []interface{}{
+		&Account{&v.Destination, nil},
+		NewAmount(&v.Amount),
+		&NullAmount{&txm.MetaData.DeliveredAmount},
+		&NullAmount{&v.SendMax},
+		&NullUint32{&v.DestinationTag},
+		&NullHash256{&v.InvoiceID},
+	}
+}
+
+func offerCreateColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.OfferCreate)
+	return []interface{}{
+		&NullUint32{&v.OfferSequence},
+		NewAmount(&v.TakerPays),
+		NewAmount(&v.TakerGets),
+		&NullUint32{&v.Expiration},
+	}
+}
+
+func offerCancelColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.OfferCancel)
+	return []interface{}{
+		&v.OfferSequence,
+	}
+}
+
+func accountSetColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.AccountSet)
+	return []interface{}{
+		&NullHash128{&v.EmailHash},
+		&NullHash256{&v.WalletLocator},
+		&NullUint32{&v.WalletSize},
+		&v.MessageKey,
+		&v.Domain,
+		&NullUint32{&v.TransferRate},
+		&NullUint32{&v.SetFlag},
+		&NullUint32{&v.ClearFlag},
+	}
+}
+
+func trustSetColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.TrustSet)
+	return []interface{}{
+		NewAmount(&v.LimitAmount),
+		&NullUint32{&v.QualityIn},
+		&NullUint32{&v.QualityOut},
+	}
+}
+
+func setRegularKeyColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.SetRegularKey)
+	return []interface{}{
+		&NullRegularKey{&v.RegularKey},
+	}
+}
+
+func setFeeColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.SetFee)
+	return []interface{}{
+		&v.BaseFee,
+		&v.ReferenceFeeUnits,
+		&v.ReserveBase,
+		&v.ReserveIncrement,
+	}
+}
+
+func amendmentColumns(txm *TransactionRow) []interface{} {
+	v := txm.Transaction.(*data.Amendment)
+	return []interface{}{
+		&Hash256{&v.Amendment},
+	}
+}
+
+// entries returns the entries read by a LedgerEntryHandler, leaving out
+// previous when its row holds no previous fields
+func entries(current, previous data.LedgerEntry, hasPrevious bool, err error) (data.LedgerEntry, data.LedgerEntry, error) {
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case !hasPrevious:
+		return current, nil, nil
+	default:
+		return current, previous, nil
+	}
+}
+
+func readAccountRoot(row *sql.Row) (data.LedgerEntry, data.LedgerEntry, error) {
+	var (
+		current, previous data.AccountRoot
+		hasPrevious       bool
+	)
+	err := row.Scan(
+		&hasPrevious,
+		NullUint{&current.Flags},
+		NullBytes{&current.Account},
+		NullUint{&current.Sequence},
+		NullValue{&current.Balance},
+		NullUint{&current.OwnerCount},
+		NullBytes{&current.RegularKey},
+		NullBytes{&current.EmailHash},
+		NullBytes{&current.WalletLocator},
+		NullUint{&current.WalletSize},
+		NullBytes{&current.MessageKey},
+		NullBytes{&current.Domain},
+		NullUint{&current.TransferRate},
+		NullUint{&previous.Flags},
+		NullUint{&previous.Sequence},
+		NullValue{&previous.Balance},
+		NullUint{&previous.OwnerCount},
+		NullBytes{&previous.RegularKey},
+		NullBytes{&previous.EmailHash},
+		NullBytes{&previous.WalletLocator},
+		NullUint{&previous.WalletSize},
+		NullBytes{&previous.MessageKey},
+		NullBytes{&previous.Domain},
+		NullUint{&previous.TransferRate},
+	)
+	return entries(&current, &previous, hasPrevious, err)
+}
+
+// offerAmounts holds the value, currency and issuer columns of
+// TakerPays and TakerGets
+type offerAmounts [6][]byte
+
+func (a *offerAmounts) set(offer *data.Offer) (err error) {
+	if offer.TakerPays, err = newAmount(a[0], a[1], a[2]); err != nil {
+		return err
+	}
+	offer.TakerGets, err = newAmount(a[3], a[4], a[5])
+	return err
+}
+
+func readOffer(row *sql.Row) (data.LedgerEntry, data.LedgerEntry, error) {
+	var (
+		current, previous               data.Offer
+		currentAmounts, previousAmounts offerAmounts
+		hasPrevious                     bool
+	)
+	err := row.Scan(
+		&hasPrevious,
+		NullUint{&current.Flags},
+		NullBytes{&current.Account},
+		NullUint{&current.Sequence},
+		&currentAmounts[0], &currentAmounts[1], &currentAmounts[2],
+		&currentAmounts[3], &currentAmounts[4], &currentAmounts[5],
+		NullUint{&current.Expiration},
+		NullBytes{&current.BookDirectory},
+		NullUint{&current.BookNode},
+		NullUint{&current.OwnerNode},
+		NullUint{&previous.Flags},
+		NullUint{&previous.Sequence},
+		&previousAmounts[0], &previousAmounts[1], &previousAmounts[2],
+		&previousAmounts[3], &previousAmounts[4], &previousAmounts[5],
+		NullUint{&previous.Expiration},
+		NullBytes{&previous.BookDirectory},
+		NullUint{&previous.BookNode},
+		NullUint{&previous.OwnerNode},
+	)
+	if err == nil {
+		err = currentAmounts.set(&current)
+	}
+	if err == nil {
+		err = previousAmounts.set(&previous)
+	}
+	return entries(&current, &previous, hasPrevious, err)
+}
+
+// rippleStateAmounts holds the Balance, its currency, and the LowLimit
+// and HighLimit columns with their issuers. The limits share the
+// currency of the balance.
+type rippleStateAmounts [6][]byte
+
+func (a *rippleStateAmounts) set(state *data.RippleState) (err error) {
+	if state.Balance, err = newAmount(a[0], a[1], nil); err != nil {
+		return err
+	}
+	if state.LowLimit, err = newAmount(a[2], a[1], a[3]); err != nil {
+		return err
+	}
+	state.HighLimit, err = newAmount(a[4], a[1], a[5])
+	return err
+}
+
+func readRippleState(row *sql.Row) (data.LedgerEntry, data.LedgerEntry, error) {
+	var (
+		current, previous               data.RippleState
+		currentAmounts, previousAmounts rippleStateAmounts
+		hasPrevious                     bool
+	)
+	err := row.Scan(
+		&hasPrevious,
+		NullUint{&current.Flags},
+		&currentAmounts[0], &currentAmounts[1], &currentAmounts[2],
+		&currentAmounts[3], &currentAmounts[4], &currentAmounts[5],
+		NullUint{&current.LowNode},
+		NullUint{&current.HighNode},
+		NullUint{&current.LowQualityIn},
+		NullUint{&current.LowQualityOut},
+		NullUint{&current.HighQualityIn},
+		NullUint{&current.HighQualityOut},
+		NullUint{&previous.Flags},
+		&previousAmounts[0], &previousAmounts[1], &previousAmounts[2],
+		&previousAmounts[3], &previousAmounts[4], &previousAmounts[5],
+		NullUint{&previous.LowNode},
+		NullUint{&previous.HighNode},
+		NullUint{&previous.LowQualityIn},
+		NullUint{&previous.LowQualityOut},
+		NullUint{&previous.HighQualityIn},
+		NullUint{&previous.HighQualityOut},
+	)
+	if err == nil {
+		err = currentAmounts.set(&current)
+	}
+	if err == nil {
+		err = previousAmounts.set(&previous)
+	}
+	return entries(&current, &previous, hasPrevious, err)
+}
+
+// readDirectory does not read back Indexes or ExchangeRate
+func readDirectory(row *sql.Row) (data.LedgerEntry, data.LedgerEntry, error) {
+	var (
+		current, previous data.Directory
+		hasPrevious       bool
+	)
+	err := row.Scan(
+		&hasPrevious,
+		NullBytes{&current.RootIndex},
+		NullBytes{&current.Owner},
+		NullBytes{&current.TakerPaysCurrency},
+		NullBytes{&current.TakerPaysIssuer},
+		NullBytes{&current.TakerGetsCurrency},
+		NullBytes{&current.TakerGetsIssuer},
+		NullUint{&current.IndexNext},
+		NullUint{&current.IndexPrevious},
+		NullBytes{&previous.RootIndex},
+		NullBytes{&previous.Owner},
+		NullBytes{&previous.TakerPaysCurrency},
+		NullBytes{&previous.TakerPaysIssuer},
+		NullBytes{&previous.TakerGetsCurrency},
+		NullBytes{&previous.TakerGetsIssuer},
+		NullUint{&previous.IndexNext},
+		NullUint{&previous.IndexPrevious},
+	)
+	return entries(&current, &previous, hasPrevious, err)
+}
+
+func readFeeSettings(row *sql.Row) (data.LedgerEntry, data.LedgerEntry, error) {
+	var (
+		current, previous data.FeeSettings
+		hasPrevious       bool
+	)
+	err := row.Scan(
+		&hasPrevious,
+		NullUint{&current.Flags},
+		NullUint{&current.BaseFee},
+		NullUint{&current.ReferenceFeeUnits},
+		NullUint{&current.ReserveBase},
+		NullUint{&current.ReserveIncrement},
+		NullUint{&previous.BaseFee},
+		NullUint{&previous.ReferenceFeeUnits},
+		NullUint{&previous.ReserveBase},
+		NullUint{&previous.ReserveIncrement},
+	)
+	return entries(&current, &previous, hasPrevious, err)
+}
+
+func readAmendments(row *sql.Row) (data.LedgerEntry, data.LedgerEntry, error) {
+	var (
+		current, previous                     data.Amendments
+		currentAmendments, previousAmendments []byte
+		hasPrevious                           bool
+	)
+	err := row.Scan(
+		&hasPrevious,
+		NullUint{&current.Flags},
+		&currentAmendments,
+		NullUint{&previous.Flags},
+		&previousAmendments,
+	)
+	current.Amendments, previous.Amendments = splitHashes(currentAmendments), splitHashes(previousAmendments)
+	return entries(&current, &previous, hasPrevious, err)
+}
+
+func readLedgerHashes(row *sql.Row) (data.LedgerEntry, data.LedgerEntry, error) {
+	var (
+		current, previous             data.LedgerHashes
+		currentHashes, previousHashes []byte
+		hasPrevious                   bool
+	)
+	err := row.Scan(
+		&hasPrevious,
+		NullUint{&current.Flags},
+		NullUint{&current.FirstLedgerSequence},
+		NullUint{&current.LastLedgerSequence},
+		&currentHashes,
+		NullUint{&previous.Flags},
+		NullUint{&previous.FirstLedgerSequence},
+		NullUint{&previous.LastLedgerSequence},
+		&previousHashes,
+	)
+	current.Hashes, previous.Hashes = splitHashes(currentHashes), splitHashes(previousHashes)
+	return entries(&current, &previous, hasPrevious, err)
+}
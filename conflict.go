@@ -0,0 +1,267 @@
+package mysql
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	gomysql "github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	errDuplicateEntry  = 1062
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+)
+
+type InsertMode int
+
+const (
+	// Existing rows are silently replaced
+	InsertReplace InsertMode = iota
+	// Rows differing from those already stored fail with a *ConflictError
+	InsertDetectConflicts
+	// Rows differing from those already stored are recorded in the
+	// Conflict table and the stored row is kept
+	InsertRecordConflicts
+)
+
+// primaryKeys holds the number of leading columns that make up each
+// table's primary key. Tables of a TransactionHandler are added from
+// its KeyColumns and those of a LedgerEntryHandler default to three.
+var primaryKeys = map[string]int{
+	"Ledger":      1,
+	"Transaction": 2,
+	"Memo":        3,
+	"LedgerEntry": 3,
+}
+
+type ConflictError struct {
+	Table            string
+	LedgerSequence   uint32
+	TransactionIndex *uint32
+	Columns          []string
+}
+
+func (e *ConflictError) Error() string {
+	if e.TransactionIndex == nil {
+		return fmt.Sprintf("Conflict in %s for ledger %d: %s", e.Table, e.LedgerSequence, strings.Join(e.Columns, ","))
+	}
+	return fmt.Sprintf("Conflict in %s for ledger %d transaction %d: %s", e.Table, e.LedgerSequence, *e.TransactionIndex, strings.Join(e.Columns, ","))
+}
+
+// conflictExecer turns REPLACE and upsert statements into INSERTs and
+// compares the arguments against the stored row when the key already
+// exists.
+type conflictExecer struct {
+	db   *sqldb
+	tx   *sql.Tx
+	mode InsertMode
+}
+
+// uncheckedColumns are not compared. A ledger is completed after it is
+// inserted and a raw blob holds nothing the other columns do not.
+var uncheckedColumns = map[string]bool{
+	"Complete": true,
+	"Raw":      true,
+}
+
+// SetInsertMode may be called while inserts are running. Each insert
+// uses the mode current when it starts.
+func (db *sqldb) SetInsertMode(mode InsertMode) {
+	atomic.StoreInt32(&db.mode, int32(mode))
+}
+
+func (db *sqldb) insertMode() InsertMode {
+	return InsertMode(atomic.LoadInt32(&db.mode))
+}
+
+func (db *sqldb) writer(tx *sql.Tx) Execer {
+	return db.newWriter(tx, db.insertMode())
+}
+
+func (db *sqldb) newWriter(tx *sql.Tx, mode InsertMode) Execer {
+	if mode == InsertReplace {
+		return tx
+	}
+	return &conflictExecer{db: db, tx: tx, mode: mode}
+}
+
+// clearColumns forgets the columns read for conflict checks, which a
+// migration may have changed.
+func (db *sqldb) clearColumns() {
+	db.columnsMu.Lock()
+	defer db.columnsMu.Unlock()
+	db.tableColumns = nil
+}
+
+func (c *conflictExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if strings.HasPrefix(query, "REPLACE") {
+		query = "INSERT" + strings.TrimPrefix(query, "REPLACE")
+	}
+	if i := strings.Index(query, " ON DUPLICATE KEY UPDATE "); i >= 0 {
+		query = query[:i] + ";"
+	}
+	result, err := c.tx.Exec(query, args...)
+	if e, ok := err.(*gomysql.MySQLError); !ok || e.Number != errDuplicateEntry {
+		return result, err
+	}
+	conflict, err := c.compare(strings.Fields(query)[2], args)
+	switch {
+	case err != nil:
+		return nil, err
+	case conflict == nil:
+		return driver.RowsAffected(0), nil
+	case c.mode == InsertRecordConflicts:
+		_, err := c.tx.Exec(statements["InsertConflict"],
+			conflict.Table,
+			conflict.LedgerSequence,
+			conflict.TransactionIndex,
+			strings.Join(conflict.Columns, ","),
+		)
+		return driver.RowsAffected(0), err
+	default:
+		return nil, conflict
+	}
+}
+
+func (c *conflictExecer) columns(table string) ([]string, error) {
+	c.db.columnsMu.Lock()
+	defer c.db.columnsMu.Unlock()
+	name := c.db.prefix + table
+	if columns, ok := c.db.tableColumns[name]; ok {
+		return columns, nil
+	}
+	rows, err := c.tx.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 0;", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if c.db.tableColumns == nil {
+		c.db.tableColumns = make(map[string][]string)
+	}
+	c.db.tableColumns[name] = columns
+	return columns, nil
+}
+
+func (c *conflictExecer) compare(table string, args []interface{}) (*ConflictError, error) {
+	keys, ok := primaryKeys[table]
+	if !ok {
+		return nil, fmt.Errorf("No primary key known for %s", table)
+	}
+	columns, err := c.columns(table)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < keys || len(args) > len(columns) {
+		return nil, fmt.Errorf("Cannot compare %d values with %s", len(args), table)
+	}
+	values := make([][]byte, len(args))
+	for i, arg := range args {
+		if values[i], err = fieldText(arg); err != nil {
+			return nil, err
+		}
+	}
+	var where []string
+	for _, column := range columns[:keys] {
+		where = append(where, column+"=?")
+	}
+	stmnt := fmt.Sprintf("SELECT %s FROM %s WHERE %s;", strings.Join(columns[:len(args)], ","), table, strings.Join(where, " AND "))
+	stored := make([]interface{}, len(args))
+	dest := make([]interface{}, len(args))
+	for i := range stored {
+		dest[i] = &stored[i]
+	}
+	if err := c.tx.QueryRow(stmnt, args[:keys]...).Scan(dest...); err != nil {
+		return nil, err
+	}
+	conflict := &ConflictError{Table: table}
+	for i := range values {
+		if uncheckedColumns[columns[i]] {
+			continue
+		}
+		same, err := sameValue(args[i], values[i], stored[i])
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			conflict.Columns = append(conflict.Columns, columns[i])
+		}
+	}
+	if len(conflict.Columns) == 0 {
+		return nil, nil
+	}
+	ledgerSequence, err := strconv.ParseUint(string(values[0]), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	conflict.LedgerSequence = uint32(ledgerSequence)
+	if keys > 1 {
+		transactionIndex, err := strconv.ParseUint(string(values[1]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		index := uint32(transactionIndex)
+		conflict.TransactionIndex = &index
+	}
+	return conflict, nil
+}
+
+// sameValue compares an argument, and its text, with the value scanned
+// from its column. Times are compared as instants to the second, as
+// DATETIME stores them, whether or not the DSN sets parseTime.
+func sameValue(arg interface{}, value []byte, stored interface{}) (bool, error) {
+	if valuer, ok := arg.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return false, err
+		}
+		arg = v
+	}
+	if t, ok := arg.(time.Time); ok {
+		switch v := stored.(type) {
+		case time.Time:
+			return t.Round(time.Second).Equal(v), nil
+		case []byte:
+			parsed, err := time.ParseInLocation(datetimeLayout, string(v), time.UTC)
+			if err != nil {
+				return false, nil
+			}
+			return t.Round(time.Second).Equal(parsed), nil
+		default:
+			return false, nil
+		}
+	}
+	text, err := fieldText(stored)
+	if err != nil {
+		return false, err
+	}
+	return sameField(value, text), nil
+}
+
+// sameField treats fixed width BINARY padding as insignificant.
+func sameField(value, stored []byte) bool {
+	if (value == nil) != (stored == nil) {
+		return false
+	}
+	if len(value) > len(stored) {
+		value, stored = stored, value
+	}
+	if !bytes.Equal(value, stored[:len(value)]) {
+		return false
+	}
+	for _, b := range stored[len(value):] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
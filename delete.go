@@ -0,0 +1,52 @@
+package mysql
+
+import (
+	"fmt"
+	"math"
+)
+
+const deleteChunkSize = 10000
+
+// DeleteLedgers removes every row for the ledgers from start to end
+// inclusive. Each table is cleared in chunks so that no single
+// statement holds locks on an unbounded number of rows. The Ledger
+// table is cleared first so that an interrupted delete shows up as
+// missing ledgers.
+func (db *sqldb) DeleteLedgers(start, end uint32) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if start > end {
+		return fmt.Errorf("Invalid ledger range: %d-%d", start, end)
+	}
+	for _, table := range ledgerTables {
+		if err := db.deleteLedgerRange(table, start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *sqldb) TruncateAfter(seq uint32) error {
+	if seq == math.MaxUint32 {
+		return nil
+	}
+	return db.DeleteLedgers(seq+1, math.MaxUint32)
+}
+
+func (db *sqldb) deleteRange(table string, start, end uint32) error {
+	stmnt := fmt.Sprintf("DELETE FROM %s WHERE LedgerSequence BETWEEN ? AND ? LIMIT %d;", table, deleteChunkSize)
+	for {
+		result, err := db.Exec(stmnt, start, end)
+		if err != nil {
+			return fmt.Errorf("%s\n%s", err, stmnt)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n < deleteChunkSize {
+			return nil
+		}
+	}
+}
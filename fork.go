@@ -0,0 +1,117 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/rubblelabs/ripple/data"
+	"time"
+)
+
+type LedgerConflict struct {
+	LedgerSequence uint32
+	Hash           data.Hash256
+	OrphanHash     data.Hash256
+	Detected       time.Time
+}
+
+// prepare readies tx for v to be written to it
+func (db *sqldb) prepare(v data.Storer, tx *sql.Tx) error {
+	switch item := v.(type) {
+	case *data.Ledger:
+		return db.replaceFork(item, tx)
+	case *data.TransactionWithMetaData:
+		return checkFork(item, tx)
+	default:
+		return nil
+	}
+}
+
+// ledgersFirst orders the ledgers in items before the transactions so
+// that a fork is replaced before any of its transactions are written.
+func ledgersFirst(items []data.Storer) []data.Storer {
+	sorted := make([]data.Storer, 0, len(items))
+	for _, item := range items {
+		if _, ok := item.(*data.Ledger); ok {
+			sorted = append(sorted, item)
+		}
+	}
+	for _, item := range items {
+		if _, ok := item.(*data.Ledger); !ok {
+			sorted = append(sorted, item)
+		}
+	}
+	return sorted
+}
+
+// checkFork refuses a transaction that is not part of the complete
+// ledger stored for its sequence. A transaction does not carry its
+// ledger hash, so this is the only fork that can be seen from it.
+// Otherwise a forked ledger must be inserted before its transactions,
+// or replaceFork will orphan them along with the ledger it replaces.
+func checkFork(t *data.TransactionWithMetaData, tx *sql.Tx) error {
+	var forked bool
+	switch err := tx.QueryRow(statements["IsForkedTransaction"], t.GetHash().Bytes(), t.LedgerSequence).Scan(&forked); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	case forked:
+		return fmt.Errorf("Transaction %s is not in complete ledger %d, insert its ledger first", t.GetHash(), t.LedgerSequence)
+	default:
+		return nil
+	}
+}
+
+// replaceFork moves a stored ledger with the same sequence as l but a
+// different hash, along with its transactions, to the orphan tables
+// and removes every row stored for that sequence. The orphans keep
+// their Raw nodes, from which the memo, path and ledger entry rows
+// can be rebuilt.
+func (db *sqldb) replaceFork(l *data.Ledger, tx *sql.Tx) error {
+	var hash data.Hash256
+	err := tx.QueryRow(statements["GetLedgerHash"], l.LedgerSequence).Scan(&Hash256{&hash})
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	case hash == *l.GetHash():
+		return nil
+	}
+	if _, err := tx.Exec(statements["InsertOrphanLedger"], l.LedgerSequence); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(statements["InsertOrphanTransaction"], hash.Bytes(), l.LedgerSequence); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(statements["InsertLedgerConflict"], l.LedgerSequence, l.GetHash().Bytes(), hash.Bytes()); err != nil {
+		return err
+	}
+	for _, table := range ledgerTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE LedgerSequence=?;", table), l.LedgerSequence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *sqldb) LedgerConflicts(start, end uint32) ([]LedgerConflict, error) {
+	rows, err := db.DB.Query(statements["GetLedgerConflicts"], start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var conflicts []LedgerConflict
+	for rows.Next() {
+		var (
+			conflict LedgerConflict
+			detected int64
+		)
+		if err := rows.Scan(&conflict.LedgerSequence, &Hash256{&conflict.Hash}, &Hash256{&conflict.OrphanHash}, &detected); err != nil {
+			return nil, err
+		}
+		conflict.Detected = time.Unix(detected, 0)
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
@@ -0,0 +1,195 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/rubblelabs/ripple/data"
+	"reflect"
+	"strings"
+)
+
+// TransactionHandler stores and reads the type specific fields of one
+// TransactionType. Handlers for types not built into this package are
+// added with RegisterTransactionHandler.
+type TransactionHandler struct {
+	Type data.TransactionType
+	// Tables keyed by LedgerSequence and TransactionIndex that Insert
+	// writes to. They are pruned and deleted along with their ledgers.
+	Tables []string
+	// Number of leading columns of each of Tables that make up its
+	// primary key, compared by InsertDetectConflicts.
+	KeyColumns []int
+	// Statements creating Tables and View. They are run by every
+	// Migrate, so must be idempotent. A table that already exists is
+	// not changed by its CREATE TABLE, so a change to it is made by
+	// appending an ALTER TABLE. One adding a column or key that exists
+	// is ignored. The tables of the built in handlers are created by
+	// the first migration.
+	Schema []string
+	// View read by TransactionQuery. Its columns are those of
+	// TransactionView followed by those returned by Columns.
+	View    string
+	Insert  func(*data.TransactionWithMetaData, Execer, Lookuper) error
+	Columns func(*TransactionRow) []interface{}
+}
+
+var transactionHandlers = make(map[data.TransactionType]*TransactionHandler)
+
+func init() {
+	for _, handler := range []*TransactionHandler{
+		{data.PAYMENT, []string{"Payment", "Path"}, []int{2, 4}, nil, "PaymentView", insertPayment, paymentColumns},
+		{data.OFFER_CREATE, []string{"OfferCreate"}, []int{2}, nil, "OfferCreateView", insertOfferCreate, offerCreateColumns},
+		{data.OFFER_CANCEL, []string{"OfferCancel"}, []int{2}, nil, "OfferCancelView", insertOfferCancel, offerCancelColumns},
+		{data.ACCOUNT_SET, []string{"AccountSet"}, []int{2}, nil, "AccountSetView", insertAccountSet, accountSetColumns},
+		{data.SET_REGULAR_KEY, []string{"SetRegularKey"}, []int{2}, nil, "SetRegularKeyView", insertSetRegularKey, setRegularKeyColumns},
+		{data.TRUST_SET, []string{"TrustSet"}, []int{2}, nil, "TrustSetView", insertTrustSet, trustSetColumns},
+		{data.SET_FEE, []string{"SetFee"}, []int{2}, nil, "SetFeeView", insertSetFee, setFeeColumns},
+		{data.AMENDMENT, []string{"Amendment"}, []int{2}, nil, "AmendmentView", insertAmendment, amendmentColumns},
+	} {
+		if err := RegisterTransactionHandler(handler); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterTransactionHandler adds support for a TransactionType. It
+// must be called before any database is opened, typically from init.
+func RegisterTransactionHandler(handler *TransactionHandler) error {
+	if _, ok := transactionHandlers[handler.Type]; ok {
+		return fmt.Errorf("Handler already registered for %s", handler.Type)
+	}
+	if handler.Insert == nil || handler.Columns == nil || handler.View == "" || len(handler.KeyColumns) != len(handler.Tables) {
+		return fmt.Errorf("Incomplete handler for %s", handler.Type)
+	}
+	transactionHandlers[handler.Type] = handler
+	ledgerTables = append(ledgerTables, handler.Tables...)
+	for i, table := range handler.Tables {
+		primaryKeys[table] = handler.KeyColumns[i]
+	}
+	return nil
+}
+
+func transactionHandler(typ data.TransactionType) (*TransactionHandler, error) {
+	handler, ok := transactionHandlers[typ]
+	if !ok {
+		return nil, fmt.Errorf("Unknown Transaction type: %s", typ)
+	}
+	return handler, nil
+}
+
+// transactionType returns the registered type called name, ignoring case
+func transactionType(name string) (data.TransactionType, bool) {
+	for typ := range transactionHandlers {
+		if strings.EqualFold(typ.String(), name) {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// MissingPrevious is how a LedgerEntryHandler treats an affected node
+// without a previous state, such as a created node or a modified node
+// whose PreviousFields were not recorded.
+type MissingPrevious int
+
+const (
+	// PreviousNil calls Insert with a nil previous entry
+	PreviousNil MissingPrevious = iota
+	// PreviousCurrent calls Insert with the current entry as previous
+	PreviousCurrent
+	// PreviousSkip stores only the LedgerEntry row
+	PreviousSkip
+	// PreviousError fails the insert of the transaction
+	PreviousError
+)
+
+// LedgerEntryHandler stores the type specific fields of one
+// LedgerEntryType for each affected node. Handlers for types not built
+// into this package are added with RegisterLedgerEntryHandler.
+type LedgerEntryHandler struct {
+	Type data.LedgerEntryType
+	// Tables keyed by LedgerSequence, TransactionIndex and NodeIndex
+	// that Insert writes to.
+	Tables []string
+	// Statements creating Tables, run like those of a
+	// TransactionHandler. The tables of the built in handlers are
+	// created by migrations.
+	Schema          []string
+	MissingPrevious MissingPrevious
+	Insert          func(pos int, txm *data.TransactionWithMetaData, current, previous data.LedgerEntry, tx Execer, lookups Lookuper) error
+	// Statement selecting the row Insert wrote for a node by
+	// LedgerSequence, TransactionIndex and position, and Read, which
+	// rebuilds the entries from it for transactions stored without Raw.
+	// Without them such nodes are rebuilt without their fields.
+	Select string
+	Read   func(row *sql.Row) (current, previous data.LedgerEntry, err error)
+}
+
+var ledgerEntryHandlers = make(map[data.LedgerEntryType]*LedgerEntryHandler)
+
+func init() {
+	for _, handler := range []*LedgerEntryHandler{
+		{data.ACCOUNT_ROOT, []string{"AccountRoot"}, nil, PreviousNil, insertAccountRoot, queries["GetAccountRootEntry"], readAccountRoot},
+		{data.OFFER, []string{"Offer"}, nil, PreviousNil, insertOffer, queries["GetOfferEntry"], readOffer},
+		{data.RIPPLE_STATE, []string{"RippleState"}, nil, PreviousNil, insertRippleState, queries["GetRippleStateEntry"], readRippleState},
+		{data.DIRECTORY, []string{"Directory"}, nil, PreviousNil, insertDirectory, queries["GetDirectoryEntry"], readDirectory},
+		{data.FEE_SETTINGS, []string{"FeeSettings"}, nil, PreviousNil, insertFeeSetting, queries["GetFeeSettingsEntry"], readFeeSettings},
+		{data.AMENDMENTS, []string{"Amendments"}, nil, PreviousNil, insertAmendments, queries["GetAmendmentsEntry"], readAmendments},
+		{data.LEDGER_HASHES, []string{"LedgerHashes"}, nil, PreviousNil, insertLedgerHashes, queries["GetLedgerHashesEntry"], readLedgerHashes},
+	} {
+		if err := RegisterLedgerEntryHandler(handler); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterLedgerEntryHandler adds support for a LedgerEntryType. It
+// must be called before any database is opened, typically from init.
+func RegisterLedgerEntryHandler(handler *LedgerEntryHandler) error {
+	if _, ok := ledgerEntryHandlers[handler.Type]; ok {
+		return fmt.Errorf("Handler already registered for %s", handler.Type)
+	}
+	if handler.Insert == nil {
+		return fmt.Errorf("Incomplete handler for %s", handler.Type)
+	}
+	ledgerEntryHandlers[handler.Type] = handler
+	ledgerTables = append(ledgerTables, handler.Tables...)
+	for _, table := range handler.Tables {
+		if _, ok := primaryKeys[table]; !ok {
+			primaryKeys[table] = 3
+		}
+	}
+	return nil
+}
+
+// insertLedgerEntry stores the type specific row of an affected node
+// according to the MissingPrevious policy of its handler. Types without
+// a handler are kept only in the Raw column of the transaction.
+func insertLedgerEntry(pos int, txm *data.TransactionWithMetaData, typ data.LedgerEntryType, current, previous data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	handler, ok := ledgerEntryHandlers[typ]
+	if !ok {
+		return nil
+	}
+	if isNilEntry(previous) {
+		switch handler.MissingPrevious {
+		case PreviousNil:
+			previous = nil
+		case PreviousCurrent:
+			previous = current
+		case PreviousSkip:
+			return nil
+		default:
+			return fmt.Errorf("Missing previous %s at node %d of %s", typ, pos, txm.GetBase().Hash)
+		}
+	}
+	return handler.Insert(pos, txm, current, previous, tx, lookups)
+}
+
+// isNilEntry reports whether e is nil or a nil pointer in an interface
+func isNilEntry(e data.LedgerEntry) bool {
+	if e == nil {
+		return true
+	}
+	v := reflect.ValueOf(e)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
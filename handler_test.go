@@ -0,0 +1,48 @@
+package mysql
+
+import (
+	"github.com/rubblelabs/ripple/data"
+	"testing"
+)
+
+func TestMissingPrevious(t *testing.T) {
+	const typ = data.LedgerEntryType(0xfff0)
+	txm := &data.TransactionWithMetaData{Transaction: &data.Payment{}}
+	current := &data.AccountRoot{}
+	defer delete(ledgerEntryHandlers, typ)
+	for _, test := range []struct {
+		policy   MissingPrevious
+		inserted bool
+		previous data.LedgerEntry
+		fails    bool
+	}{
+		{PreviousNil, true, nil, false},
+		{PreviousCurrent, true, current, false},
+		{PreviousSkip, false, nil, false},
+		{PreviousError, false, nil, true},
+	} {
+		var (
+			inserted bool
+			previous data.LedgerEntry
+		)
+		ledgerEntryHandlers[typ] = &LedgerEntryHandler{
+			Type:            typ,
+			MissingPrevious: test.policy,
+			Insert: func(pos int, txm *data.TransactionWithMetaData, current, prev data.LedgerEntry, tx Execer, lookups Lookuper) error {
+				inserted, previous = true, prev
+				return nil
+			},
+		}
+		// A typed nil, as left by a node without PreviousFields
+		var missing *data.AccountRoot
+		err := insertLedgerEntry(0, txm, typ, current, missing, nil, nil)
+		switch {
+		case (err != nil) != test.fails:
+			t.Errorf("Policy %d: %v", test.policy, err)
+		case inserted != test.inserted:
+			t.Errorf("Policy %d: inserted %t", test.policy, inserted)
+		case previous != test.previous:
+			t.Errorf("Policy %d: inserted with previous %v", test.policy, previous)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rubblelabs/ripple/data"
+	"sync"
+)
+
+var errIngestStopped = errors.New("Ingester stopped")
+
+// IngestJob is the work for a single ledger. Load is called from the
+// worker pool, so any decoding should happen there.
+type IngestJob struct {
+	LedgerSequence uint32
+	Load           func() ([]data.Storer, error)
+}
+
+// Ingester writes ledgers with a pool of workers and commits them in
+// ledger order, checkpointing the last committed ledger under Name.
+type Ingester struct {
+	Name    string
+	Workers int
+	db      *sqldb
+}
+
+type ingested struct {
+	ledgerSequence uint32
+	tx             *sql.Tx
+	lookups        *lookupTx
+	err            error
+}
+
+// ingestOrder holds the next ledger to commit, so that a worker can wait
+// for the ledgers before its own.
+type ingestOrder struct {
+	mu      sync.Mutex
+	next    uint32
+	changed chan struct{}
+}
+
+func newIngestOrder(next uint32) *ingestOrder {
+	return &ingestOrder{next: next, changed: make(chan struct{})}
+}
+
+func (o *ingestOrder) advance(next uint32) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next = next
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+// wait returns once every ledger before ledgerSequence has committed
+func (o *ingestOrder) wait(ctx context.Context, ledgerSequence uint32, quit <-chan struct{}) error {
+	for {
+		o.mu.Lock()
+		next, changed := o.next, o.changed
+		o.mu.Unlock()
+		if next >= ledgerSequence {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-quit:
+			return errIngestStopped
+		}
+	}
+}
+
+func NewIngester(db IndexedDB, name string, workers int) (*Ingester, error) {
+	inner, ok := db.(*sqldb)
+	if !ok {
+		return nil, fmt.Errorf("Cannot ingest into %T", db)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &Ingester{
+		Name:    name,
+		Workers: workers,
+		db:      inner,
+	}, nil
+}
+
+// Checkpoint returns the last ledger committed by this ingester, or
+// zero if it has never committed one.
+func (i *Ingester) Checkpoint() (uint32, error) {
+	var ledgerSequence uint32
+	err := i.db.QueryRow(statements["GetCheckpoint"], i.Name).Scan(&ledgerSequence)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return ledgerSequence, err
+}
+
+// Run ingests jobs, which must arrive in ledger order starting at start.
+// Jobs before start are skipped, so a restarted ingester can be handed
+// the same stream with start set to Checkpoint()+1.
+func (i *Ingester) Run(start uint32, jobs <-chan IngestJob) error {
+	return i.RunContext(context.Background(), start, jobs)
+}
+
+// RunContext is Run, stopping when ctx is done. Once it stops for any
+// reason the remaining jobs are drained in the background, so a
+// producer is never left blocked on a send. It should still close jobs.
+func (i *Ingester) RunContext(ctx context.Context, start uint32, jobs <-chan IngestJob) error {
+	var (
+		work    = make(chan IngestJob)
+		results = make(chan *ingested)
+		window  = make(chan struct{}, 2*i.Workers)
+		quit    = make(chan struct{})
+		order   = newIngestOrder(start)
+		feedErr error
+		wg      sync.WaitGroup
+	)
+	go func() {
+		defer close(work)
+		defer func() {
+			go func() {
+				for range jobs {
+				}
+			}()
+		}()
+		next := start
+		for {
+			var job IngestJob
+			select {
+			case j, ok := <-jobs:
+				if !ok {
+					return
+				}
+				job = j
+			case <-ctx.Done():
+				feedErr = ctx.Err()
+				return
+			case <-quit:
+				return
+			}
+			if job.LedgerSequence < start {
+				continue
+			}
+			if job.LedgerSequence != next {
+				feedErr = fmt.Errorf("Expected ledger %d, got %d", next, job.LedgerSequence)
+				return
+			}
+			if i.db.partitionsNeeded(job.LedgerSequence) {
+				// Adding partitions waits on the metadata locks held by
+				// uncommitted ledgers, so let those commit first. This
+				// happens once every partitionsAhead partitions.
+				for n := 0; n < cap(window); n++ {
+					select {
+					case window <- struct{}{}:
+					case <-ctx.Done():
+						feedErr = ctx.Err()
+						return
+					case <-quit:
+						return
+					}
+				}
+				err := i.db.ensurePartitions(job.LedgerSequence)
+				for n := 0; n < cap(window); n++ {
+					<-window
+				}
+				if err != nil {
+					feedErr = err
+					return
+				}
+			}
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				feedErr = ctx.Err()
+				return
+			case <-quit:
+				return
+			}
+			work <- job
+			next++
+		}
+	}()
+	for w := 0; w < i.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range work {
+				results <- i.ingest(ctx, job, order, quit)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	var (
+		pending = make(map[uint32]*ingested)
+		next    = start
+		err     error
+	)
+	for result := range results {
+		if err != nil {
+			if result.tx != nil {
+				result.tx.Rollback()
+			}
+			continue
+		}
+		pending[result.ledgerSequence] = result
+		for p, ok := pending[next]; ok; p, ok = pending[next] {
+			delete(pending, next)
+			<-window
+			if err = i.commit(p); err != nil {
+				close(quit)
+				break
+			}
+			next++
+			order.advance(next)
+		}
+	}
+	for _, p := range pending {
+		if p.tx != nil {
+			p.tx.Rollback()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return feedErr
+}
+
+func (i *Ingester) ingest(ctx context.Context, job IngestJob, order *ingestOrder, quit <-chan struct{}) *ingested {
+	result := &ingested{ledgerSequence: job.LedgerSequence}
+	nodes, err := job.Load()
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if result.tx, result.err = i.db.BeginTx(ctx, nil); result.err != nil {
+		return result
+	}
+	// Ledgers commit in order, so a new lookup value waits for the
+	// ledgers before it rather than on the lookup table locks of a
+	// later ledger, which would in turn wait for it to commit.
+	result.lookups = i.db.lookupTx(result.tx)
+	result.lookups.wait = func() error {
+		return order.wait(ctx, job.LedgerSequence, quit)
+	}
+	result.err = i.db.insertBatch(nodes, result.tx, result.lookups)
+	return result
+}
+
+func (i *Ingester) commit(p *ingested) error {
+	if p.err != nil {
+		if p.lookups != nil {
+			return p.lookups.rollback(p.err)
+		}
+		if p.tx != nil {
+			return rollback(p.tx, p.err)
+		}
+		return p.err
+	}
+	if _, err := p.tx.Exec(statements["UpdateCheckpoint"], i.Name, p.ledgerSequence); err != nil {
+		return p.lookups.rollback(err)
+	}
+	return p.lookups.commit()
+}
@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"github.com/rubblelabs/ripple/data"
 	"github.com/rubblelabs/ripple/storage"
@@ -10,16 +11,60 @@ type Query interface {
 	Rows(*sql.Tx, *QueryResult) error
 }
 
+type ContextQuery interface {
+	Query
+	RowsContext(context.Context, *sql.Tx, *QueryResult) error
+}
+
+// Lookuper resolves values to the Ids stored in their lookup tables,
+// inserting them when they are not yet present.
+type Lookuper interface {
+	LookupAccount(*data.Account) (uint32, error)
+	LookupCurrency(*data.Currency) (uint32, error)
+	LookupRegularKey(*data.RegularKey) (uint32, error)
+	LookupPublicKey(*data.PublicKey) (uint32, error)
+}
+
 type IndexedDB interface {
 	storage.DB
+	InsertBatch([]data.Storer) error
+	SetInsertMode(InsertMode)
+	CompleteLedger(*data.Ledger, []*data.TransactionWithMetaData) error
+	InsertContext(context.Context, data.Storer) error
+	GetContext(context.Context, data.Hash256) (data.Storer, error)
 	Query(Query, *QueryResult) error
+	QueryContext(context.Context, Query, *QueryResult) error
 	InsertLookup(string, *LookupItem) error
-	GetLookups(string) ([]LookupItem, error)
+	GetLookups(string, ...interface{}) ([]LookupItem, error)
+	WriteLookupSnapshot(path string) error
+	GetLookupId(string, *LookupItem) error
+	GetLookupValue(string, *LookupItem) error
+	GetLookupValues(string, []uint32) ([]LookupItem, error)
 	GetAccount(uint32) *data.Account
-	LookupAccount(*data.Account) (uint32, error)
-	LookupCurrency(*data.Currency) (uint32, error)
-	LookupRegularKey(*data.RegularKey) (uint32, error)
-	LookupPublicKey(*data.PublicKey) (uint32, error)
+	GetCurrency(uint32) *data.Currency
+	GetRegularKey(uint32) *data.RegularKey
+	GetPublicKey(uint32) *data.PublicKey
+	GetAccounts([]uint32) ([]*data.Account, error)
+	GetCurrencies([]uint32) ([]*data.Currency, error)
+	GetRegularKeys([]uint32) ([]*data.RegularKey, error)
+	GetPublicKeys([]uint32) ([]*data.PublicKey, error)
+	Lookuper
+	FindAccount(*data.Account) (uint32, error)
+	FindAccountContext(context.Context, *data.Account) (uint32, error)
+	FindCurrency(*data.Currency) (uint32, error)
+	FindRegularKey(*data.RegularKey) (uint32, error)
+	FindPublicKey(*data.PublicKey) (uint32, error)
 	SearchAccounts(s string) ([]string, error)
+	SearchAccountsContext(ctx context.Context, s string) ([]string, error)
 	MissingLedgers(start, end uint32) ([]uint32, error)
+	MissingLedgersContext(ctx context.Context, start, end uint32) ([]uint32, error)
+	MissingCompleteLedgers(start, end uint32) ([]uint32, error)
+	LedgerConflicts(start, end uint32) ([]LedgerConflict, error)
+	DeleteLedgers(start, end uint32) error
+	TruncateAfter(seq uint32) error
+	PrunedBefore() (uint32, error)
+	PrunedBeforeContext(ctx context.Context) (uint32, error)
+	EnablePartitioning(size uint32) error
+	Migrate() error
+	SchemaStatus() (*SchemaStatus, error)
 }
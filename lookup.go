@@ -1,18 +1,54 @@
 package mysql
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"database/sql"
 	"github.com/rubblelabs/ripple/data"
-	"reflect"
+	"github.com/rubblelabs/ripple/storage"
 	"sync"
 )
 
-type lookup struct {
-	m      map[interface{}]uint32
-	r      map[uint32]interface{}
-	mu     sync.RWMutex
-	db     IndexedDB
-	insert string
+// lookupDB is the part of IndexedDB used by lookups
+type lookupDB interface {
+	InsertLookup(string, *LookupItem) error
+	GetLookups(string, ...interface{}) ([]LookupItem, error)
+	GetLookupIdContext(context.Context, string, *LookupItem) error
+	GetLookupValue(string, *LookupItem) error
+	GetLookupValues(string, []uint32) ([]LookupItem, error)
+}
+
+// lookup maps the values of a lookup table, which are fixed size
+// arrays, to their Ids and back.
+type lookup[K comparable] struct {
+	cache    lookupCache[K]
+	bounded  bool
+	db       lookupDB
+	stmnts   lookupStatements
+	codec    lookupCodec[K]
+	seed     *K
+	snapshot *snapshotTable
+	once     sync.Once
+	err      error
+}
+
+// lookupStatements names the statements used by a lookup table
+type lookupStatements struct {
+	Table  string
+	All    string // every row
+	After  string // every row with a greater Id
+	Insert string
+	Id     string // the Id of a value
+	Value  string // the value of an Id
+	Values string // the values of several Ids
+}
+
+// lookupCodec converts the values of a lookup table to and from the
+// columns that store them
+type lookupCodec[K comparable] struct {
+	bytes func(*K) []byte
+	value func([]byte) K
+	human func(*K) string
 }
 
 type LookupItem struct {
@@ -21,153 +57,440 @@ type LookupItem struct {
 	Human string
 }
 
-func newLookup(get, insert string, db IndexedDB, typ reflect.Type) (*lookup, error) {
-	items, err := db.GetLookups(get)
+// lookupConfig describes how a lookup caches its table
+type lookupConfig struct {
+	policy   LookupCachePolicy
+	size     int
+	snapshot map[string]*snapshotTable
+}
+
+func newLookup[K comparable](stmnts lookupStatements, codec lookupCodec[K], db lookupDB, seed *K, cfg lookupConfig) (*lookup[K], error) {
+	l := &lookup[K]{
+		db:       db,
+		stmnts:   stmnts,
+		codec:    codec,
+		seed:     seed,
+		snapshot: cfg.snapshot[stmnts.Table],
+	}
+	switch cfg.policy {
+	case LookupCacheBounded:
+		l.cache, l.bounded = newLRUCache[K](cfg.size), true
+	default:
+		l.cache = newMapCache[K]()
+	}
+	if cfg.policy == LookupCacheLazy {
+		return l, nil
+	}
+	return l, l.load()
+}
+
+func (l *lookup[K]) load() error {
+	l.once.Do(func() { l.err = l.fill() })
+	return l.err
+}
+
+// fill loads every row unless the cache is bounded, in which case rows
+// are loaded as they are used. Rows held in a current snapshot are not
+// read.
+func (l *lookup[K]) fill() error {
+	if !l.bounded {
+		stmnt, args := l.stmnts.All, []interface{}(nil)
+		current, err := l.snapshotCurrent()
+		if err != nil {
+			return err
+		}
+		if current {
+			for i, id := range l.snapshot.Ids {
+				l.cache.add(l.codec.value(l.snapshot.Values[i]), id)
+			}
+			stmnt, args = l.stmnts.After, []interface{}{l.snapshot.Max}
+		}
+		l.snapshot = nil
+		items, err := l.db.GetLookups(stmnt, args...)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			l.cache.add(l.codec.value(item.Value.([]byte)), item.Id)
+		}
+	}
+	if l.seed == nil {
+		return nil
+	}
+	if _, err := l.resolve(l.seed); err != nil && err != ErrReadOnly {
+		return err
+	}
+	return nil
+}
+
+// snapshotCurrent reports whether the table still holds the snapshot's
+// row at Max, which it would not if the table had been rebuilt since.
+func (l *lookup[K]) snapshotCurrent() (bool, error) {
+	if l.snapshot == nil || len(l.snapshot.Ids) == 0 {
+		return false, nil
+	}
+	item := &LookupItem{Id: l.snapshot.Max}
+	switch err := l.db.GetLookupValue(l.stmnts.Value, item); err {
+	case nil:
+	case storage.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+	for i, id := range l.snapshot.Ids {
+		if id == l.snapshot.Max {
+			return bytes.Equal(l.snapshot.Values[i], item.Value.([]byte)), nil
+		}
+	}
+	return false, nil
+}
+
+// item returns the row to insert for value
+func (l *lookup[K]) item(value *K) *LookupItem {
+	return &LookupItem{
+		Value: l.codec.bytes(value),
+		Human: l.codec.human(value),
+	}
+}
+
+// find returns the Id of value from the cache or, when the cache is
+// bounded, from the database.
+func (l *lookup[K]) find(ctx context.Context, value *K) (uint32, bool, error) {
+	if id, ok := l.cache.id(*value); ok || !l.bounded {
+		return id, ok, nil
+	}
+	item := l.item(value)
+	switch err := l.db.GetLookupIdContext(ctx, l.stmnts.Id, item); err {
+	case nil:
+		l.cache.add(*value, item.Id)
+		return item.Id, true, nil
+	case storage.ErrNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, err
+	}
+}
+
+func (l *lookup[K]) get(n uint32) (K, bool) {
+	var zero K
+	if l.load() != nil {
+		return zero, false
+	}
+	if v, ok := l.cache.value(n); ok || !l.bounded {
+		return v, ok
+	}
+	item := &LookupItem{Id: n}
+	if err := l.db.GetLookupValue(l.stmnts.Value, item); err != nil {
+		return zero, false
+	}
+	v := l.codec.value(item.Value.([]byte))
+	l.cache.add(v, n)
+	return v, true
+}
+
+// getMany returns the values of ids in order, with nil for unknown Ids.
+// When the cache is bounded the misses are read in a single query.
+func (l *lookup[K]) getMany(ids []uint32) ([]*K, error) {
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	values := make([]*K, len(ids))
+	var missing []uint32
+	for i, id := range ids {
+		if v, ok := l.cache.value(id); ok {
+			values[i] = &v
+		} else if l.bounded {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+	items, err := l.db.GetLookupValues(l.stmnts.Values, missing)
 	if err != nil {
 		return nil, err
 	}
-	m := make(map[interface{}]uint32)
-	r := make(map[uint32]interface{})
+	found := make(map[uint32]K, len(items))
 	for _, item := range items {
-		v := reflect.New(typ).Elem()
-		reflect.Copy(v, reflect.ValueOf(item.Value))
-		m[v.Interface()] = item.Id
-		r[item.Id] = v.Interface()
-	}
-	return &lookup{
-		m:      m,
-		r:      r,
-		db:     db,
-		insert: insert,
-	}, nil
-}
-
-func (l *lookup) add(v interface{}) (uint32, bool) {
-	l.mu.RLock()
-	if id, ok := l.m[v]; ok {
-		l.mu.RUnlock()
-		return id, true
-	}
-	l.mu.RUnlock()
-	// Promote lock
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	if id, ok := l.m[v]; ok {
-		return id, true
-	}
-	id := uint32(len(l.m))
-	l.m[v] = id
-	l.r[id] = v
-	return id, false
-}
-
-func (l *lookup) get(n uint32) interface{} {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	return l.r[n]
-}
-
-func (l *lookup) Lookup(value interface{}) (uint32, error) {
-	v := reflect.Indirect(reflect.ValueOf(value))
-	id, ok := l.add(v.Interface())
-	if ok {
+		v := l.codec.value(item.Value.([]byte))
+		l.cache.add(v, item.Id)
+		found[item.Id] = v
+	}
+	for i, id := range ids {
+		if v, ok := found[id]; ok && values[i] == nil {
+			values[i] = &v
+		}
+	}
+	return values, nil
+}
+
+func (l *lookup[K]) Get(n uint32) *K {
+	if v, ok := l.get(n); ok {
+		return &v
+	}
+	return nil
+}
+
+func (l *lookup[K]) GetMany(ns []uint32) ([]*K, error) {
+	return l.getMany(ns)
+}
+
+func (l *lookup[K]) Lookup(value *K) (uint32, error) {
+	if err := l.load(); err != nil {
+		return 0, err
+	}
+	return l.resolve(value)
+}
+
+// Find returns the Id of value without inserting it, or
+// storage.ErrNotFound if it has none.
+func (l *lookup[K]) Find(value *K) (uint32, error) {
+	return l.FindContext(context.Background(), value)
+}
+
+func (l *lookup[K]) FindContext(ctx context.Context, value *K) (uint32, error) {
+	if err := l.load(); err != nil {
+		return 0, err
+	}
+	id, ok, err := l.find(ctx, value)
+	switch {
+	case err != nil:
+		return 0, err
+	case !ok:
+		return 0, storage.ErrNotFound
+	default:
+		return id, nil
+	}
+}
+
+func (l *lookup[K]) resolve(value *K) (uint32, error) {
+	if id, ok, err := l.find(context.Background(), value); ok || err != nil {
+		return id, err
+	}
+	item := l.item(value)
+	if err := l.db.InsertLookup(l.stmnts.Insert, item); err != nil {
+		return 0, err
+	}
+	l.cache.add(*value, item.Id)
+	return item.Id, nil
+}
+
+// lookupTx inserts lookup values within a transaction. The values it
+// inserts are only added to the shared caches when the transaction
+// commits, and are forgotten when it rolls back.
+type lookupTx struct {
+	db          *sqldb
+	tx          *sql.Tx
+	accounts    map[data.Account]uint32
+	currencies  map[data.Currency]uint32
+	regularKeys map[data.RegularKey]uint32
+	publicKeys  map[data.PublicKey]uint32
+	// wait, if set, is called before a value is inserted
+	wait func() error
+}
+
+func (db *sqldb) lookupTx(tx *sql.Tx) *lookupTx {
+	t := &lookupTx{db: db, tx: tx}
+	t.reset()
+	return t
+}
+
+func (t *lookupTx) reset() {
+	t.accounts = make(map[data.Account]uint32)
+	t.currencies = make(map[data.Currency]uint32)
+	t.regularKeys = make(map[data.RegularKey]uint32)
+	t.publicKeys = make(map[data.PublicKey]uint32)
+}
+
+func resolveTx[K comparable](t *lookupTx, l *lookup[K], pending map[K]uint32, value *K) (uint32, error) {
+	if err := l.load(); err != nil {
+		return 0, err
+	}
+	// A bounded cache would otherwise read the database for a value
+	// this transaction has already resolved
+	if id, ok := pending[*value]; ok {
 		return id, nil
 	}
-	item := &LookupItem{
-		Id:    id,
-		Value: v.Slice(0, v.Len()).Interface(),
-		Human: value.(fmt.Stringer).String(),
+	if id, ok, err := l.find(context.Background(), value); ok || err != nil {
+		return id, err
+	}
+	if t.wait != nil {
+		if err := t.wait(); err != nil {
+			return 0, err
+		}
+		// The transactions waited for may have added value
+		if id, ok, err := l.find(context.Background(), value); ok || err != nil {
+			return id, err
+		}
+	}
+	item := l.item(value)
+	if err := t.db.insertLookup(t.tx, l.stmnts.Insert, item); err != nil {
+		return 0, err
+	}
+	pending[*value] = item.Id
+	return item.Id, nil
+}
+
+func publish[K comparable](l *lookup[K], pending map[K]uint32) {
+	for value, id := range pending {
+		l.cache.add(value, id)
+	}
+}
+
+// commit commits the transaction and publishes its lookup values
+func (t *lookupTx) commit() error {
+	if err := t.tx.Commit(); err != nil {
+		return err
 	}
-	err := l.db.InsertLookup(l.insert, item)
-	return id, err
+	publish(t.db.accounts.lookup, t.accounts)
+	publish(t.db.currencies.lookup, t.currencies)
+	publish(t.db.regularKeys.lookup, t.regularKeys)
+	publish(t.db.publicKeys.lookup, t.publicKeys)
+	return nil
+}
+
+// rollback rolls back the transaction and forgets its lookup values
+func (t *lookupTx) rollback(err error) error {
+	t.reset()
+	return rollback(t.tx, err)
+}
+
+func (t *lookupTx) LookupAccount(a *data.Account) (uint32, error) {
+	return resolveTx(t, t.db.accounts.lookup, t.accounts, a)
+}
+
+func (t *lookupTx) LookupCurrency(c *data.Currency) (uint32, error) {
+	return resolveTx(t, t.db.currencies.lookup, t.currencies, c)
+}
+
+func (t *lookupTx) LookupRegularKey(r *data.RegularKey) (uint32, error) {
+	return resolveTx(t, t.db.regularKeys.lookup, t.regularKeys, r)
+}
+
+func (t *lookupTx) LookupPublicKey(p *data.PublicKey) (uint32, error) {
+	return resolveTx(t, t.db.publicKeys.lookup, t.publicKeys, p)
 }
 
 type AccountLookup struct {
-	*lookup
+	*lookup[data.Account]
+}
+
+var accountCodec = lookupCodec[data.Account]{
+	bytes: func(a *data.Account) []byte { return a[:] },
+	value: func(b []byte) (a data.Account) { copy(a[:], b); return },
+	human: func(a *data.Account) string { return a.String() },
 }
 
 func NewAddressLookup(db IndexedDB) (*AccountLookup, error) {
-	lookup, err := newLookup("GetAccounts", "InsertAccount", db, reflect.TypeOf(data.Account{}))
-	if err != nil {
-		return nil, err
-	}
+	return newAddressLookup(db, lookupConfig{})
+}
+
+func newAddressLookup(db lookupDB, cfg lookupConfig) (*AccountLookup, error) {
 	//TODO Move to data
 	var accountZero data.Account
-	if _, err = lookup.Lookup(&accountZero); err != nil {
+	lookup, err := newLookup(lookupStatements{
+		Table:  "Account",
+		All:    "GetAccounts",
+		After:  "GetAccountsAfter",
+		Insert: "InsertAccount",
+		Id:     "GetAccountId",
+		Value:  "GetAccount",
+		Values: "GetAccountsById",
+	}, accountCodec, db, &accountZero, cfg)
+	if err != nil {
 		return nil, err
 	}
 	return &AccountLookup{lookup}, nil
 }
 
-func (l *AccountLookup) Get(n uint32) *data.Account {
-	if account := l.get(n); account != nil {
-		a := account.(data.Account)
-		return &a
-	}
-	return nil
+type RegularKeyLookup struct {
+	*lookup[data.RegularKey]
 }
 
-type RegularKeyLookup struct {
-	*lookup
+var regularKeyCodec = lookupCodec[data.RegularKey]{
+	bytes: func(r *data.RegularKey) []byte { return r[:] },
+	value: func(b []byte) (r data.RegularKey) { copy(r[:], b); return },
+	human: func(r *data.RegularKey) string { return r.String() },
 }
 
 func NewRegularKeyLookup(db IndexedDB) (*RegularKeyLookup, error) {
-	lookup, err := newLookup("GetRegularKeys", "InsertRegularKey", db, reflect.TypeOf(data.RegularKey{}))
+	return newRegularKeyLookup(db, lookupConfig{})
+}
+
+func newRegularKeyLookup(db lookupDB, cfg lookupConfig) (*RegularKeyLookup, error) {
+	lookup, err := newLookup(lookupStatements{
+		Table:  "RegularKey",
+		All:    "GetRegularKeys",
+		After:  "GetRegularKeysAfter",
+		Insert: "InsertRegularKey",
+		Id:     "GetRegularKeyId",
+		Value:  "GetRegularKey",
+		Values: "GetRegularKeysById",
+	}, regularKeyCodec, db, nil, cfg)
 	if err != nil {
 		return nil, err
 	}
 	return &RegularKeyLookup{lookup}, nil
 }
 
-func (l *RegularKeyLookup) Get(n uint32) *data.RegularKey {
-	if regKey := l.get(n); regKey != nil {
-		r := regKey.(data.RegularKey)
-		return &r
-	}
-	return nil
+type PublicKeyLookup struct {
+	*lookup[data.PublicKey]
 }
 
-type PublicKeyLookup struct {
-	*lookup
+var publicKeyCodec = lookupCodec[data.PublicKey]{
+	bytes: func(p *data.PublicKey) []byte { return p[:] },
+	value: func(b []byte) (p data.PublicKey) { copy(p[:], b); return },
+	human: func(p *data.PublicKey) string { return p.String() },
 }
 
 func NewPublicKeyLookup(db IndexedDB) (*PublicKeyLookup, error) {
-	lookup, err := newLookup("GetPublicKeys", "InsertPublicKey", db, reflect.TypeOf(data.PublicKey{}))
+	return newPublicKeyLookup(db, lookupConfig{})
+}
+
+func newPublicKeyLookup(db lookupDB, cfg lookupConfig) (*PublicKeyLookup, error) {
+	lookup, err := newLookup(lookupStatements{
+		Table:  "PublicKey",
+		All:    "GetPublicKeys",
+		After:  "GetPublicKeysAfter",
+		Insert: "InsertPublicKey",
+		Id:     "GetPublicKeyId",
+		Value:  "GetPublicKey",
+		Values: "GetPublicKeysById",
+	}, publicKeyCodec, db, nil, cfg)
 	if err != nil {
 		return nil, err
 	}
 	return &PublicKeyLookup{lookup}, nil
 }
 
-func (l *PublicKeyLookup) Get(n uint32) *data.PublicKey {
-	if publicKey := l.get(n); publicKey != nil {
-		p := publicKey.(data.PublicKey)
-		return &p
-	}
-	return nil
+type CurrencyLookup struct {
+	*lookup[data.Currency]
 }
 
-type CurrencyLookup struct {
-	*lookup
+var currencyCodec = lookupCodec[data.Currency]{
+	bytes: func(c *data.Currency) []byte { return c[:] },
+	value: func(b []byte) (c data.Currency) { copy(c[:], b); return },
+	human: func(c *data.Currency) string { return c.String() },
 }
 
 func NewCurrencyLookup(db IndexedDB) (*CurrencyLookup, error) {
-	lookup, err := newLookup("GetCurrencies", "InsertCurrency", db, reflect.TypeOf(data.Currency{}))
-	if err != nil {
-		return nil, err
-	}
+	return newCurrencyLookup(db, lookupConfig{})
+}
+
+func newCurrencyLookup(db lookupDB, cfg lookupConfig) (*CurrencyLookup, error) {
 	//TODO Move to data
 	var xrp data.Currency
-	if _, err = lookup.Lookup(&xrp); err != nil {
+	lookup, err := newLookup(lookupStatements{
+		Table:  "Currency",
+		All:    "GetCurrencies",
+		After:  "GetCurrenciesAfter",
+		Insert: "InsertCurrency",
+		Id:     "GetCurrencyId",
+		Value:  "GetCurrency",
+		Values: "GetCurrenciesById",
+	}, currencyCodec, db, &xrp, cfg)
+	if err != nil {
 		return nil, err
 	}
 	return &CurrencyLookup{lookup}, nil
 }
-
-func (l *CurrencyLookup) Get(n uint32) *data.Currency {
-	if currency := l.get(n); currency != nil {
-		c := currency.(data.Currency)
-		return &c
-	}
-	return nil
-}
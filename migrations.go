@@ -0,0 +1,302 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	gomysql "github.com/go-sql-driver/mysql"
+	"strings"
+)
+
+const (
+	errDuplicateColumn  = 1060
+	errDuplicateKeyName = 1061
+)
+
+type migration struct {
+	Version     uint32
+	Description string
+	Statements  []string
+}
+
+type SchemaStatus struct {
+	Version uint32
+	Latest  uint32
+	Pending []string
+}
+
+// migrations are applied in order and must never be edited once
+// released. Add a new migration for every schema change.
+var migrations = []migration{
+	{1, "Initial schema", schema},
+	{2, "Ledger completeness, checkpoints, conflicts, forks and retention", []string{`
+ALTER TABLE Ledger ADD COLUMN Complete BOOLEAN NOT NULL DEFAULT FALSE AFTER Hash;
+`, `
+CREATE TABLE IF NOT EXISTS Checkpoint (
+  Name VARCHAR(64) NOT NULL,
+  LedgerSequence INT UNSIGNED NOT NULL,
+  Updated DATETIME NOT NULL,
+  PRIMARY KEY(Name)
+);
+`, `
+CREATE TABLE IF NOT EXISTS Conflict (
+  Id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  TableName VARCHAR(64) NOT NULL,
+  LedgerSequence INT UNSIGNED NOT NULL,
+  TransactionIndex INT UNSIGNED NULL,
+  Columns VARCHAR(2048) NOT NULL,
+  Detected DATETIME NOT NULL,
+  PRIMARY KEY(Id),
+  KEY(LedgerSequence,TransactionIndex)
+);
+`, `
+CREATE TABLE IF NOT EXISTS LedgerConflict (
+  LedgerSequence INT UNSIGNED NOT NULL,
+  Hash BINARY(32) NOT NULL,
+  OrphanHash BINARY(32) NOT NULL,
+  Detected DATETIME NOT NULL,
+  PRIMARY KEY(LedgerSequence,OrphanHash)
+);
+`, `
+CREATE TABLE IF NOT EXISTS OrphanLedger (
+  LedgerSequence INT UNSIGNED NOT NULL,
+  TotalXRP BIGINT UNSIGNED NOT NULL,
+  PreviousLedger BINARY(32) NOT NULL,
+  TransactionHash BINARY(32) NOT NULL,
+  StateHash BINARY(32) NOT NULL,
+  ParentCloseTime INT UNSIGNED NOT NULL,
+  CloseTime INT UNSIGNED NOT NULL,
+  CloseResolution TINYINT UNSIGNED NOT NULL,
+  CloseFlags TINYINT UNSIGNED NOT NULL,
+  Hash BINARY(32) NOT NULL,
+  Orphaned DATETIME NOT NULL,
+  PRIMARY KEY(Hash),
+  KEY(LedgerSequence)
+);
+`, `
+CREATE TABLE IF NOT EXISTS OrphanTransaction (
+  LedgerHash BINARY(32) NOT NULL,
+  LedgerSequence INT UNSIGNED NOT NULL,
+  TransactionIndex INT UNSIGNED NOT NULL,
+  TransactionResult TINYINT UNSIGNED NOT NULL,
+  TransactionType MEDIUMINT UNSIGNED NOT NULL,
+  Account INT UNSIGNED NOT NULL,
+  Hash BINARY(32) NOT NULL,
+  PRIMARY KEY(LedgerHash,TransactionIndex),
+  KEY(Hash)
+);
+`, `
+CREATE TABLE IF NOT EXISTS Retention (
+  Id TINYINT UNSIGNED NOT NULL,
+  PrunedBefore INT UNSIGNED NOT NULL,
+  Updated DATETIME NOT NULL,
+  PRIMARY KEY(Id)
+);
+`}},
+	// Version 3 is not used
+	{4, "Unique lookup values", []string{
+		`ALTER TABLE Account ADD UNIQUE KEY Account(Account);`,
+		`ALTER TABLE RegularKey ADD UNIQUE KEY RegularKey(RegularKey);`,
+		`ALTER TABLE PublicKey ADD UNIQUE KEY PublicKey(PublicKey);`,
+		`ALTER TABLE Currency ADD UNIQUE KEY Currency(Currency);`,
+	}},
+	{5, "Amendments and LedgerHashes ledger entries", []string{`
+CREATE TABLE IF NOT EXISTS Amendments (
+  LedgerSequence INT UNSIGNED NOT NULL,
+  TransactionIndex INT UNSIGNED NOT NULL,
+  Position MEDIUMINT UNSIGNED NOT NULL,
+  Flags INT UNSIGNED NOT NULL,
+  Amendments BLOB NULL,
+  Previous_Flags INT UNSIGNED NULL,
+  Previous_Amendments BLOB NULL,
+  PRIMARY KEY(LedgerSequence,TransactionIndex,Position)
+);
+`, `
+CREATE TABLE IF NOT EXISTS LedgerHashes (
+  LedgerSequence INT UNSIGNED NOT NULL,
+  TransactionIndex INT UNSIGNED NOT NULL,
+  Position MEDIUMINT UNSIGNED NOT NULL,
+  Flags INT UNSIGNED NOT NULL,
+  FirstLedgerSequence INT UNSIGNED NULL,
+  LastLedgerSequence INT UNSIGNED NULL,
+  Hashes MEDIUMBLOB NULL,
+  Previous_Flags INT UNSIGNED NULL,
+  Previous_FirstLedgerSequence INT UNSIGNED NULL,
+  Previous_LastLedgerSequence INT UNSIGNED NULL,
+  Previous_Hashes MEDIUMBLOB NULL,
+  PRIMARY KEY(LedgerSequence,TransactionIndex,Position),
+  KEY(LastLedgerSequence)
+);
+`}},
+	{6, "Raw ledgers and transactions", []string{
+		`ALTER TABLE Ledger ADD COLUMN Raw BLOB NULL;`,
+		`ALTER TABLE Transaction ADD COLUMN Raw MEDIUMBLOB NULL;`,
+	}},
+	{7, "Raw orphan ledgers and transactions", []string{
+		`ALTER TABLE OrphanLedger ADD COLUMN Raw BLOB NULL;`,
+		`ALTER TABLE OrphanTransaction ADD COLUMN Raw MEDIUMBLOB NULL;`,
+	}},
+}
+
+// migrationChecks refuse to apply a migration to a database it would
+// fail part way through on, explaining how to fix the database first.
+var migrationChecks = map[uint32]func(context.Context, *sql.Conn) error{
+	4: checkUniqueLookups,
+}
+
+// checkUniqueLookups finds lookup values stored under more than one Id.
+// The rows referring to the duplicate Ids must be remapped by hand.
+func checkUniqueLookups(ctx context.Context, conn *sql.Conn) error {
+	for _, table := range []string{"Account", "RegularKey", "PublicKey", "Currency"} {
+		var n, keep, duplicate uint32
+		stmnt := fmt.Sprintf("SELECT COUNT(*),COALESCE(MIN(Keep),0),COALESCE(MIN(Duplicate),0) FROM (SELECT MIN(Id) Keep,MAX(Id) Duplicate FROM %s GROUP BY %s HAVING COUNT(*)>1)d;", table, table)
+		if err := conn.QueryRowContext(ctx, stmnt).Scan(&n, &keep, &duplicate); err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%d values of %s are stored more than once, for example Ids %d and %d. Point every column referring to a duplicate Id at the lowest Id for its value, delete the duplicate rows and run Migrate again", n, table, keep, duplicate)
+		}
+	}
+	return nil
+}
+
+var schemaVersion = `
+CREATE TABLE IF NOT EXISTS SchemaVersion (
+  Version INT UNSIGNED NOT NULL,
+  Description VARCHAR(255) NOT NULL,
+  Applied DATETIME NOT NULL,
+  PRIMARY KEY(Version)
+);
+`
+
+func latestVersion() uint32 {
+	return migrations[len(migrations)-1].Version
+}
+
+func (db *sqldb) SchemaStatus() (*SchemaStatus, error) {
+	status := &SchemaStatus{Latest: latestVersion()}
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=?;`, db.prefix+"SchemaVersion").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists > 0 {
+		if err := db.QueryRow(statements["GetSchemaVersion"]).Scan(&status.Version); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range migrations {
+		if m.Version > status.Version {
+			status.Pending = append(status.Pending, m.Description)
+		}
+	}
+	return status, nil
+}
+
+func (db *sqldb) checkSchema() error {
+	status, err := db.SchemaStatus()
+	if err != nil {
+		return err
+	}
+	if status.Version > status.Latest {
+		return fmt.Errorf("Database schema version %d is newer than supported version %d", status.Version, status.Latest)
+	}
+	return nil
+}
+
+// checkMigrated also refuses a schema with pending migrations
+func (db *sqldb) checkMigrated() error {
+	if err := db.checkSchema(); err != nil {
+		return err
+	}
+	status, err := db.SchemaStatus()
+	if err != nil {
+		return err
+	}
+	if len(status.Pending) > 0 {
+		return fmt.Errorf("Database schema version %d is older than version %d, run Migrate: %s", status.Version, status.Latest, strings.Join(status.Pending, ", "))
+	}
+	return nil
+}
+
+// Migrate applies every pending migration. Concurrent callers are
+// serialised with a named lock. Databases created before versioning
+// start at version zero, so columns and keys that already exist are
+// tolerated.
+//
+// MySQL commits each DDL statement implicitly, so a migration is not
+// atomic. One that fails partway is left unrecorded with some of its
+// statements applied. Every statement may be run again, so calling
+// Migrate once the cause is fixed resumes it.
+func (db *sqldb) Migrate() error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var locked int
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(CONCAT(DATABASE(),'.migrate'),60);`).Scan(&locked); err != nil {
+		return err
+	}
+	if locked != 1 {
+		return fmt.Errorf("Timed out waiting for migration lock")
+	}
+	defer conn.ExecContext(ctx, `SELECT RELEASE_LOCK(CONCAT(DATABASE(),'.migrate'));`)
+	defer db.clearColumns()
+	if _, err := conn.ExecContext(ctx, schemaVersion); err != nil {
+		return err
+	}
+	if err := db.checkSchema(); err != nil {
+		return err
+	}
+	var version uint32
+	if err := conn.QueryRowContext(ctx, statements["GetSchemaVersion"]).Scan(&version); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if check, ok := migrationChecks[m.Version]; ok {
+			if err := check(ctx, conn); err != nil {
+				return fmt.Errorf("Migration %d: %s", m.Version, err)
+			}
+		}
+		for _, stmnt := range m.Statements {
+			if err := execMigration(ctx, conn, stmnt); err != nil {
+				return fmt.Errorf("Migration %d: %s\n%s", m.Version, err, stmnt)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, statements["InsertSchemaVersion"], m.Version, m.Description); err != nil {
+			return err
+		}
+	}
+	for _, handler := range transactionHandlers {
+		for _, stmnt := range handler.Schema {
+			if err := execMigration(ctx, conn, stmnt); err != nil {
+				return fmt.Errorf("%s handler: %s\n%s", handler.Type, err, stmnt)
+			}
+		}
+	}
+	for _, handler := range ledgerEntryHandlers {
+		for _, stmnt := range handler.Schema {
+			if err := execMigration(ctx, conn, stmnt); err != nil {
+				return fmt.Errorf("%s handler: %s\n%s", handler.Type, err, stmnt)
+			}
+		}
+	}
+	return nil
+}
+
+// execMigration runs stmnt, ignoring a column or key it adds that
+// already exists.
+func execMigration(ctx context.Context, conn *sql.Conn, stmnt string) error {
+	_, err := conn.ExecContext(ctx, stmnt)
+	if e, ok := err.(*gomysql.MySQLError); ok && (e.Number == errDuplicateColumn || e.Number == errDuplicateKeyName) {
+		return nil
+	}
+	return err
+}
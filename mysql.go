@@ -1,84 +1,141 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	gomysql "github.com/go-sql-driver/mysql"
 	"github.com/rubblelabs/ripple/data"
 	"github.com/rubblelabs/ripple/storage"
+	"strings"
+	"sync"
+	"time"
 )
 
 type sqldb struct {
 	*sql.DB
 	name        string
+	prefix      string
 	accounts    *AccountLookup
 	regularKeys *RegularKeyLookup
 	publicKeys  *PublicKeyLookup
 	currencies  *CurrencyLookup
+	mode        int32
+	readOnly    bool
+
+	replicas      []*replica
+	replicaLag    uint32
+	replicaLagTTL time.Duration
+	nextReplica   uint32
+
+	partitionMu        sync.Mutex
+	partitionSize      uint64
+	partitionBounds    map[string]uint64
+	partitionMaxValues map[string]string
+
+	columnsMu    sync.Mutex
+	tableColumns map[string][]string
 }
 
+// NewMySqlDB opens the database named in conn, applying any pending
+// migrations. When drop is set the database is reset, see Options.
 func NewMySqlDB(conn string, drop bool) (IndexedDB, error) {
-	inner, err := sql.Open("mysql", conn)
-	if err != nil {
-		return nil, err
-	}
-	db := &sqldb{DB: inner}
-	if err := db.QueryRow("SELECT DATABASE();").Scan(&db.name); err != nil {
-		return nil, err
-	}
-	if drop {
-		if _, err := db.Exec("DROP DATABASE " + db.name + ";"); err != nil {
-			return nil, err
-		}
-		if _, err := db.Exec("CREATE DATABASE " + db.name + ";"); err != nil {
-			return nil, err
-		}
-		if _, err := db.Exec("USE " + db.name + ";"); err != nil {
-			return nil, err
-		}
-	}
-	if err := db.execSchema(); err != nil {
-		return nil, err
+	return NewMySqlDBWithOptions(Options{DSN: conn, Reset: drop, Migrate: true})
+}
+
+// Insert stores a ledger or transaction. It never marks a ledger
+// complete; use CompleteLedger or InsertBatch for that. A complete
+// ledger inserted again stays complete unless its hash has changed. A
+// ledger that replaces a fork must be inserted before its transactions.
+func (db *sqldb) Insert(v data.Storer) error {
+	return db.InsertContext(context.Background(), v)
+}
+
+func (db *sqldb) InsertContext(ctx context.Context, v data.Storer) error {
+	if err := db.writable(); err != nil {
+		return err
 	}
-	if db.accounts, err = NewAddressLookup(db); err != nil {
-		return nil, err
+	if err := db.ensurePartitions(ledgerSequence(v)); err != nil {
+		return err
 	}
-	if db.regularKeys, err = NewRegularKeyLookup(db); err != nil {
-		return nil, err
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	if db.publicKeys, err = NewPublicKeyLookup(db); err != nil {
-		return nil, err
+	if err := db.prepare(v, tx); err != nil {
+		return rollback(tx, err)
 	}
-	if db.currencies, err = NewCurrencyLookup(db); err != nil {
-		return nil, err
+	lookups := db.lookupTx(tx)
+	if err := db.insert(v, db.writer(tx), lookups); err != nil {
+		return lookups.rollback(err)
 	}
-	return db, nil
+	return lookups.commit()
 }
 
-func (db *sqldb) Insert(v data.Storer) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+func (db *sqldb) insert(v data.Storer, tx Execer, lookups Lookuper) error {
+	switch item := v.(type) {
+	case *data.Ledger:
+		return db.insertLedger(item, tx)
+	case *data.TransactionWithMetaData:
+		return db.insertTransactionWithMetadata(item, tx, lookups)
+	default:
+		return fmt.Errorf("Item %+v cannot be inserted into database", item)
 	}
+}
+
+func ledgerSequence(v data.Storer) uint32 {
 	switch item := v.(type) {
 	case *data.Ledger:
-		err = db.insertLedger(item, tx)
+		return item.LedgerSequence
 	case *data.TransactionWithMetaData:
-		err = db.insertTransactionWithMetadata(item, tx)
+		return item.LedgerSequence
 	default:
-		err = fmt.Errorf("Item %+v cannot be inserted into database", item)
+		return 0
 	}
-	if err != nil {
-		if errRollBack := tx.Rollback(); errRollBack != nil {
-			return fmt.Errorf("%s:%s", err.Error(), errRollBack.Error())
-		}
-		return err
+}
+
+const (
+	maxLookupAttempts = 10
+	maxLookupIds      = 1000
+)
+
+var lookupIds = map[string]string{
+	"InsertAccount":    "LockAccountId",
+	"InsertRegularKey": "LockRegularKeyId",
+	"InsertPublicKey":  "LockPublicKeyId",
+	"InsertCurrency":   "LockCurrencyId",
+}
+
+// retryable reports whether a lookup insert failing with err may be
+// retried. A deadlock rolls back the whole of an enclosing transaction.
+func retryable(err error, inTx bool) bool {
+	e, ok := err.(*gomysql.MySQLError)
+	if !ok {
+		return false
+	}
+	switch e.Number {
+	case errDuplicateEntry, errLockWaitTimeout:
+		return true
+	case errDeadlock:
+		return !inTx
+	default:
+		return false
+	}
+}
+
+func rollback(tx *sql.Tx, err error) error {
+	if errRollBack := tx.Rollback(); errRollBack != nil {
+		return fmt.Errorf("%s:%s", err.Error(), errRollBack.Error())
 	}
-	return tx.Commit()
+	return err
 }
 
-func (db *sqldb) insertLedger(l *data.Ledger, tx *sql.Tx) error {
-	_, err := tx.Exec(statements["InsertLedger"],
+func (db *sqldb) insertLedger(l *data.Ledger, tx Execer) error {
+	raw, err := rawNode(l)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(statements["InsertLedger"],
 		l.LedgerSequence,
 		l.TotalXRP,
 		l.PreviousLedger.Bytes(),
@@ -89,26 +146,86 @@ func (db *sqldb) insertLedger(l *data.Ledger, tx *sql.Tx) error {
 		l.CloseResolution,
 		l.CloseFlags,
 		l.GetHash().Bytes(),
+		false,
+		raw,
 	)
 	return err
 }
 
-func (db *sqldb) insertTransactionWithMetadata(t *data.TransactionWithMetaData, tx *sql.Tx) error {
+// CompleteLedger marks l as complete once txs are verified against its
+// TransactionHash and stored. Completing a complete ledger succeeds.
+func (db *sqldb) CompleteLedger(l *data.Ledger, txs []*data.TransactionWithMetaData) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	complete, err := db.completeLedger(l, txs, tx)
+	switch {
+	case err != nil:
+		return rollback(tx, err)
+	case !complete:
+		return rollback(tx, fmt.Errorf("Ledger %d is incomplete", l.LedgerSequence))
+	default:
+		return tx.Commit()
+	}
+}
+
+// completeLedger marks a ledger as complete when txs hash to its
+// TransactionHash and every one of them has been stored.
+func (db *sqldb) completeLedger(l *data.Ledger, txs []*data.TransactionWithMetaData, tx *sql.Tx) (bool, error) {
+	hash, err := transactionTreeHash(txs)
+	if err != nil {
+		return false, err
+	}
+	if hash != l.TransactionHash {
+		return false, nil
+	}
+	var count int
+	if err := tx.QueryRow(statements["CountTransactions"], l.LedgerSequence).Scan(&count); err != nil {
+		return false, err
+	}
+	if count != len(txs) {
+		return false, nil
+	}
+	if _, err := tx.Exec(statements["CompleteLedger"], l.LedgerSequence, l.GetHash().Bytes()); err != nil {
+		return false, err
+	}
+	// An UPDATE of a ledger that is already complete affects no rows
+	var complete bool
+	switch err := tx.QueryRow(statements["IsLedgerComplete"], l.LedgerSequence, l.GetHash().Bytes()).Scan(&complete); err {
+	case nil:
+		return complete, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (db *sqldb) insertTransactionWithMetadata(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
 	base := t.GetBase()
-	_, err := tx.Exec(statements["InsertTransaction"],
+	raw, err := rawNode(t)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(statements["InsertTransaction"],
 		t.LedgerSequence,
 		t.MetaData.TransactionIndex,
 		t.MetaData.TransactionResult,
 		base.TransactionType,
 		base.Flags,
 		base.SourceTag,
-		&Account{&base.Account, db},
+		&Account{&base.Account, lookups},
 		base.Sequence,
 		base.LastLedgerSequence,
 		base.Fee.Bytes(),
-		&PublicKey{base.SigningPubKey, db},
+		&PublicKey{base.SigningPubKey, lookups},
 		base.TxnSignature.Bytes(),
 		base.Hash.Bytes(),
+		raw,
 	)
 	if err != nil {
 		return err
@@ -139,208 +256,211 @@ func (db *sqldb) insertTransactionWithMetadata(t *data.TransactionWithMetaData,
 		if err != nil {
 			return err
 		}
-		// out, _ := json.MarshalIndent(node, "", "\t")
-		// fmt.Println(state, string(out))
-		switch e := current.(type) {
-		case *data.AccountRoot:
-			err = db.insertAccountRoot(pos, t, e, previous.(*data.AccountRoot), tx)
-		case *data.RippleState:
-			err = db.insertRippleState(pos, t, e, previous.(*data.RippleState), tx)
-		case *data.Offer:
-			err = db.insertOffer(pos, t, e, previous.(*data.Offer), tx)
-		case *data.Directory:
-			err = db.insertDirectory(pos, t, e, previous.(*data.Directory), tx)
-		case *data.FeeSettings:
-			err = db.insertFeeSetting(pos, t, e, previous.(*data.FeeSettings), tx)
-		default:
-			return fmt.Errorf("Unknown LedgerEntryType: %+v", e)
-		}
-		if err != nil {
+		if err := insertLedgerEntry(pos, t, node.LedgerEntryType, current, previous, tx, lookups); err != nil {
 			return err
 		}
 	}
-	switch item := t.Transaction.(type) {
-	case *data.Payment:
-		return db.insertPayment(item, t, tx)
-	case *data.OfferCreate:
-		return db.insertOfferCreate(item, t, tx)
-	case *data.OfferCancel:
-		return db.insertOfferCancel(item, t, tx)
-	case *data.AccountSet:
-		return db.insertAccountSet(item, t, tx)
-	case *data.SetRegularKey:
-		return db.insertSetRegularKey(item, t, tx)
-	case *data.TrustSet:
-		return db.insertTrustSet(item, t, tx)
-	case *data.SetFee:
-		return db.insertSetFee(item, t, tx)
-	case *data.Amendment:
-		return db.insertAmendment(item, t, tx)
-	default:
-		return fmt.Errorf("Unknown Transaction type")
+	// Types without a handler are kept only in Raw
+	handler, ok := transactionHandlers[base.TransactionType]
+	if !ok {
+		return nil
 	}
+	return handler.Insert(t, tx, lookups)
 }
 
-func (db *sqldb) insertAccountRoot(pos int, txm *data.TransactionWithMetaData, current, previous *data.AccountRoot, tx *sql.Tx) error {
-	_, err := tx.Exec(statements["InsertAccountRoot"],
+func insertAccountRoot(pos int, txm *data.TransactionWithMetaData, currentEntry, previousEntry data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	current := currentEntry.(*data.AccountRoot)
+	args := []interface{}{
 		txm.LedgerSequence,
 		txm.MetaData.TransactionIndex,
 		pos,
 		getOrDefault(current.Flags),
-		&Account{current.Account, db},
+		&Account{current.Account, lookups},
 		current.Sequence,
 		current.Balance.Bytes(),
 		getOrDefault(current.OwnerCount),
-		&RegularKey{current.RegularKey, db},
+		&RegularKey{current.RegularKey, lookups},
 		current.EmailHash.Bytes(),
 		current.WalletLocator.Bytes(),
 		current.WalletSize,
 		current.MessageKey.Bytes(),
 		current.Domain.Bytes(),
 		current.TransferRate,
-		previous.Flags,
-		previous.Sequence,
-		previous.Balance.Bytes(),
-		previous.OwnerCount,
-		&RegularKey{previous.RegularKey, db},
-		previous.EmailHash.Bytes(),
-		previous.WalletLocator.Bytes(),
-		previous.WalletSize,
-		previous.MessageKey.Bytes(),
-		previous.Domain.Bytes(),
-		previous.TransferRate,
-	)
+	}
+	if previous, _ := previousEntry.(*data.AccountRoot); previous != nil {
+		args = append(args,
+			previous.Flags,
+			previous.Sequence,
+			previous.Balance.Bytes(),
+			previous.OwnerCount,
+			&RegularKey{previous.RegularKey, lookups},
+			previous.EmailHash.Bytes(),
+			previous.WalletLocator.Bytes(),
+			previous.WalletSize,
+			previous.MessageKey.Bytes(),
+			previous.Domain.Bytes(),
+			previous.TransferRate,
+		)
+	} else {
+		args = append(args, make([]interface{}, 11)...)
+	}
+	_, err := tx.Exec(statements["InsertAccountRoot"], args...)
 	return err
 }
 
-func (db *sqldb) insertRippleState(pos int, txm *data.TransactionWithMetaData, current, previous *data.RippleState, tx *sql.Tx) error {
+func insertRippleState(pos int, txm *data.TransactionWithMetaData, currentEntry, previousEntry data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	current := currentEntry.(*data.RippleState)
 	if (current.Balance.Currency != current.LowLimit.Currency) ||
 		(current.Balance.Currency != current.HighLimit.Currency) {
 		return fmt.Errorf("Bad assumptions!")
 	}
-	var (
-		previousBalance   = NewAmount(previous.Balance)
-		previousLowLimit  = NewAmount(previous.LowLimit)
-		previousHighLimit = NewAmount(previous.HighLimit)
-	)
-	if err := previousBalance.Lookup(db); err != nil {
-		return err
-	}
-	if err := previousLowLimit.Lookup(db); err != nil {
-		return err
-	}
-	if err := previousHighLimit.Lookup(db); err != nil {
-		return err
-	}
-	_, err := tx.Exec(statements["InsertRippleState"],
+	args := []interface{}{
 		txm.LedgerSequence,
 		txm.MetaData.TransactionIndex,
 		pos,
 		current.Flags,
 		current.Balance.Value.Bytes(),
-		&Currency{&current.Balance.Currency, db},
+		&Currency{&current.Balance.Currency, lookups},
 		current.LowLimit.Value.Bytes(),
-		&Account{&current.LowLimit.Issuer, db},
+		&Account{&current.LowLimit.Issuer, lookups},
 		current.HighLimit.Value.Bytes(),
-		&Account{&current.HighLimit.Issuer, db},
+		&Account{&current.HighLimit.Issuer, lookups},
 		current.LowNode,
 		current.HighNode,
 		current.LowQualityIn,
 		current.LowQualityOut,
 		current.HighQualityIn,
 		current.HighQualityOut,
-		previous.Flags,
-		previousBalance.Value,
-		previousBalance.Currency,
-		previousLowLimit.Value,
-		previousLowLimit.Issuer,
-		previousHighLimit.Value,
-		previousHighLimit.Issuer,
-		previous.LowNode,
-		previous.HighNode,
-		previous.LowQualityIn,
-		previous.LowQualityOut,
-		previous.HighQualityIn,
-		previous.HighQualityOut,
-	)
+	}
+	if previous, _ := previousEntry.(*data.RippleState); previous != nil {
+		var (
+			previousBalance   = NewAmount(previous.Balance)
+			previousLowLimit  = NewAmount(previous.LowLimit)
+			previousHighLimit = NewAmount(previous.HighLimit)
+		)
+		if err := previousBalance.Lookup(lookups); err != nil {
+			return err
+		}
+		if err := previousLowLimit.Lookup(lookups); err != nil {
+			return err
+		}
+		if err := previousHighLimit.Lookup(lookups); err != nil {
+			return err
+		}
+		args = append(args,
+			previous.Flags,
+			previousBalance.Value,
+			previousBalance.Currency,
+			previousLowLimit.Value,
+			previousLowLimit.Issuer,
+			previousHighLimit.Value,
+			previousHighLimit.Issuer,
+			previous.LowNode,
+			previous.HighNode,
+			previous.LowQualityIn,
+			previous.LowQualityOut,
+			previous.HighQualityIn,
+			previous.HighQualityOut,
+		)
+	} else {
+		args = append(args, make([]interface{}, 13)...)
+	}
+	_, err := tx.Exec(statements["InsertRippleState"], args...)
 	return err
 }
 
-func (db *sqldb) insertOffer(pos int, txm *data.TransactionWithMetaData, current, previous *data.Offer, tx *sql.Tx) error {
-	var (
-		previousTakerPays = NewAmount(previous.TakerPays)
-		previousTakerGets = NewAmount(previous.TakerGets)
-	)
-	if err := previousTakerPays.Lookup(db); err != nil {
-		return err
-	}
-	if err := previousTakerGets.Lookup(db); err != nil {
-		return err
-	}
-	_, err := tx.Exec(statements["InsertOffer"],
+func insertOffer(pos int, txm *data.TransactionWithMetaData, currentEntry, previousEntry data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	current := currentEntry.(*data.Offer)
+	args := []interface{}{
 		txm.LedgerSequence,
 		txm.MetaData.TransactionIndex,
 		pos,
 		getOrDefault(current.Flags),
-		&Account{current.Account, db},
+		&Account{current.Account, lookups},
 		current.Sequence,
 		current.TakerPays.Value.Bytes(),
-		&Currency{&current.TakerPays.Currency, db},
-		&Account{&current.TakerPays.Issuer, db},
+		&Currency{&current.TakerPays.Currency, lookups},
+		&Account{&current.TakerPays.Issuer, lookups},
 		current.TakerGets.Value.Bytes(),
-		&Currency{&current.TakerGets.Currency, db},
-		&Account{&current.TakerGets.Issuer, db},
+		&Currency{&current.TakerGets.Currency, lookups},
+		&Account{&current.TakerGets.Issuer, lookups},
 		current.Expiration,
 		current.BookDirectory.Bytes(),
 		current.BookNode,
 		current.OwnerNode,
-		previous.Flags,
-		previous.Sequence,
-		previousTakerPays.Value,
-		previousTakerPays.Currency,
-		previousTakerPays.Issuer,
-		previousTakerGets.Value,
-		previousTakerGets.Currency,
-		previousTakerGets.Issuer,
-		previous.Expiration,
-		previous.BookDirectory,
-		previous.BookNode,
-		previous.OwnerNode,
-	)
+	}
+	if previous, _ := previousEntry.(*data.Offer); previous != nil {
+		var (
+			previousTakerPays = NewAmount(previous.TakerPays)
+			previousTakerGets = NewAmount(previous.TakerGets)
+		)
+		if err := previousTakerPays.Lookup(lookups); err != nil {
+			return err
+		}
+		if err := previousTakerGets.Lookup(lookups); err != nil {
+			return err
+		}
+		args = append(args,
+			previous.Flags,
+			previous.Sequence,
+			previousTakerPays.Value,
+			previousTakerPays.Currency,
+			previousTakerPays.Issuer,
+			previousTakerGets.Value,
+			previousTakerGets.Currency,
+			previousTakerGets.Issuer,
+			previous.Expiration,
+			previous.BookDirectory,
+			previous.BookNode,
+			previous.OwnerNode,
+		)
+	} else {
+		args = append(args, make([]interface{}, 12)...)
+	}
+	_, err := tx.Exec(statements["InsertOffer"], args...)
 	return err
 }
 
-func (db *sqldb) insertDirectory(pos int, txm *data.TransactionWithMetaData, current, previous *data.Directory, tx *sql.Tx) error {
-	_, err := tx.Exec(statements["InsertDirectory"],
+func insertDirectory(pos int, txm *data.TransactionWithMetaData, currentEntry, previousEntry data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	current := currentEntry.(*data.Directory)
+	args := []interface{}{
 		txm.LedgerSequence,
 		txm.MetaData.TransactionIndex,
 		pos,
 		current.RootIndex.Bytes(),
 		current.Indexes,
-		&Account{current.Owner, db},
-		&Currency{current.TakerPaysCurrency.Currency(), db},
-		&Account{current.TakerPaysIssuer.Account(), db},
-		&Currency{current.TakerGetsCurrency.Currency(), db},
-		&Account{current.TakerGetsIssuer.Account(), db},
+		&Account{current.Owner, lookups},
+		&Currency{current.TakerPaysCurrency.Currency(), lookups},
+		&Account{current.TakerPaysIssuer.Account(), lookups},
+		&Currency{current.TakerGetsCurrency.Currency(), lookups},
+		&Account{current.TakerGetsIssuer.Account(), lookups},
 		current.ExchangeRate.Bytes(),
 		current.IndexNext,
 		current.IndexPrevious,
-		previous.RootIndex,
-		previous.Indexes,
-		&Account{previous.Owner, db},
-		&Currency{previous.TakerPaysCurrency.Currency(), db},
-		&Account{previous.TakerPaysIssuer.Account(), db},
-		&Currency{previous.TakerGetsCurrency.Currency(), db},
-		&Account{previous.TakerGetsIssuer.Account(), db},
-		previous.ExchangeRate.Bytes(),
-		previous.IndexNext,
-		previous.IndexPrevious,
-	)
+	}
+	if previous, _ := previousEntry.(*data.Directory); previous != nil {
+		args = append(args,
+			previous.RootIndex,
+			previous.Indexes,
+			&Account{previous.Owner, lookups},
+			&Currency{previous.TakerPaysCurrency.Currency(), lookups},
+			&Account{previous.TakerPaysIssuer.Account(), lookups},
+			&Currency{previous.TakerGetsCurrency.Currency(), lookups},
+			&Account{previous.TakerGetsIssuer.Account(), lookups},
+			previous.ExchangeRate.Bytes(),
+			previous.IndexNext,
+			previous.IndexPrevious,
+		)
+	} else {
+		args = append(args, make([]interface{}, 10)...)
+	}
+	_, err := tx.Exec(statements["InsertDirectory"], args...)
 	return err
 }
 
-func (db *sqldb) insertFeeSetting(pos int, txm *data.TransactionWithMetaData, current, previous *data.FeeSettings, tx *sql.Tx) error {
-	_, err := tx.Exec(statements["InsertFeeSettings"],
+func insertFeeSetting(pos int, txm *data.TransactionWithMetaData, currentEntry, previousEntry data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	current := currentEntry.(*data.FeeSettings)
+	args := []interface{}{
 		txm.LedgerSequence,
 		txm.MetaData.TransactionIndex,
 		pos,
@@ -349,32 +469,99 @@ func (db *sqldb) insertFeeSetting(pos int, txm *data.TransactionWithMetaData, cu
 		current.ReferenceFeeUnits,
 		current.ReserveBase,
 		current.ReserveIncrement,
-		current.Flags,
-		previous.BaseFee,
-		previous.ReferenceFeeUnits,
-		previous.ReserveBase,
-		previous.ReserveIncrement,
-	)
+	}
+	// Previous_Flags is not nullable and has always held the current flags
+	args = append(args, getOrDefault(current.Flags))
+	if previous, _ := previousEntry.(*data.FeeSettings); previous != nil {
+		args = append(args,
+			previous.BaseFee,
+			previous.ReferenceFeeUnits,
+			previous.ReserveBase,
+			previous.ReserveIncrement,
+		)
+	} else {
+		args = append(args, make([]interface{}, 4)...)
+	}
+	_, err := tx.Exec(statements["InsertFeeSettings"], args...)
 	return err
 }
 
-func (db *sqldb) insertPayment(payment *data.Payment, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertAmendments(pos int, txm *data.TransactionWithMetaData, currentEntry, previousEntry data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	current := currentEntry.(*data.Amendments)
+	args := []interface{}{
+		txm.LedgerSequence,
+		txm.MetaData.TransactionIndex,
+		pos,
+		getOrDefault(current.Flags),
+		hashesBytes(current.Amendments),
+	}
+	if previous, _ := previousEntry.(*data.Amendments); previous != nil {
+		args = append(args,
+			getOrDefault(previous.Flags),
+			hashesBytes(previous.Amendments),
+		)
+	} else {
+		args = append(args, make([]interface{}, 2)...)
+	}
+	_, err := tx.Exec(statements["InsertAmendments"], args...)
+	return err
+}
+
+func insertLedgerHashes(pos int, txm *data.TransactionWithMetaData, currentEntry, previousEntry data.LedgerEntry, tx Execer, lookups Lookuper) error {
+	current := currentEntry.(*data.LedgerHashes)
+	args := []interface{}{
+		txm.LedgerSequence,
+		txm.MetaData.TransactionIndex,
+		pos,
+		getOrDefault(current.Flags),
+		current.FirstLedgerSequence,
+		current.LastLedgerSequence,
+		hashesBytes(current.Hashes),
+	}
+	if previous, _ := previousEntry.(*data.LedgerHashes); previous != nil {
+		args = append(args,
+			getOrDefault(previous.Flags),
+			previous.FirstLedgerSequence,
+			previous.LastLedgerSequence,
+			hashesBytes(previous.Hashes),
+		)
+	} else {
+		args = append(args, make([]interface{}, 4)...)
+	}
+	_, err := tx.Exec(statements["InsertLedgerHashes"], args...)
+	return err
+}
+
+// hashesBytes concatenates hashes, returning nil for an empty list
+func hashesBytes(hashes []data.Hash256) []byte {
+	if len(hashes) == 0 {
+		return nil
+	}
+	b := make([]byte, 0, len(hashes)*len(data.Hash256{}))
+	for _, hash := range hashes {
+		b = append(b, hash[:]...)
+	}
+	return b
+}
+
+func insertPayment(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	payment := t.Transaction.(*data.Payment)
 	amount := NewAmount(&payment.Amount)
-	if err := amount.Lookup(db); err != nil {
+	if err := amount.Lookup(lookups); err != nil {
 		return err
 	}
 	delivered := NewAmount(t.MetaData.DeliveredAmount)
-	if err := delivered.Lookup(db); err != nil {
+	if err := delivered.Lookup(lookups); err != nil {
 		return err
 	}
 	sendmax := NewAmount(payment.SendMax)
-	if err := sendmax.Lookup(db); err != nil {
+	if err := sendmax.Lookup(lookups); err != nil {
 		return err
 	}
 	_, err := tx.Exec(statements["InsertPayment"],
 		t.LedgerSequence,
 		t.MetaData.TransactionIndex,
-		&Account{&payment.Destination, db},
+		&Account{&payment.Destination, lookups},
 		amount.Value,
 		amount.Currency,
 		amount.Issuer,
@@ -400,9 +587,9 @@ func (db *sqldb) insertPayment(payment *data.Payment, t *data.TransactionWithMet
 				t.MetaData.TransactionIndex,
 				i,
 				j,
-				&Account{path.Account, db},
-				&Currency{path.Currency, db},
-				&Account{path.Issuer, db},
+				&Account{path.Account, lookups},
+				&Currency{path.Currency, lookups},
+				&Account{path.Issuer, lookups},
 			)
 			if err != nil {
 				return err
@@ -413,13 +600,14 @@ func (db *sqldb) insertPayment(payment *data.Payment, t *data.TransactionWithMet
 	return err
 }
 
-func (db *sqldb) insertOfferCreate(offer *data.OfferCreate, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertOfferCreate(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	offer := t.Transaction.(*data.OfferCreate)
 	takerPays := NewAmount(&offer.TakerPays)
-	if err := takerPays.Lookup(db); err != nil {
+	if err := takerPays.Lookup(lookups); err != nil {
 		return err
 	}
 	takerGets := NewAmount(&offer.TakerGets)
-	if err := takerGets.Lookup(db); err != nil {
+	if err := takerGets.Lookup(lookups); err != nil {
 		return err
 	}
 	_, err := tx.Exec(statements["InsertOfferCreate"],
@@ -437,7 +625,8 @@ func (db *sqldb) insertOfferCreate(offer *data.OfferCreate, t *data.TransactionW
 	return err
 }
 
-func (db *sqldb) insertOfferCancel(offer *data.OfferCancel, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertOfferCancel(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	offer := t.Transaction.(*data.OfferCancel)
 	_, err := tx.Exec(statements["InsertOfferCancel"],
 		t.LedgerSequence,
 		t.MetaData.TransactionIndex,
@@ -446,7 +635,8 @@ func (db *sqldb) insertOfferCancel(offer *data.OfferCancel, t *data.TransactionW
 	return err
 }
 
-func (db *sqldb) insertAccountSet(accountset *data.AccountSet, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertAccountSet(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	accountset := t.Transaction.(*data.AccountSet)
 	_, err := tx.Exec(statements["InsertAccountSet"],
 		t.LedgerSequence,
 		t.MetaData.TransactionIndex,
@@ -462,18 +652,20 @@ func (db *sqldb) insertAccountSet(accountset *data.AccountSet, t *data.Transacti
 	return err
 }
 
-func (db *sqldb) insertSetRegularKey(keyset *data.SetRegularKey, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertSetRegularKey(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	keyset := t.Transaction.(*data.SetRegularKey)
 	_, err := tx.Exec(statements["InsertSetRegularKey"],
 		t.LedgerSequence,
 		t.MetaData.TransactionIndex,
-		&RegularKey{keyset.RegularKey, db},
+		&RegularKey{keyset.RegularKey, lookups},
 	)
 	return err
 }
 
-func (db *sqldb) insertTrustSet(trustset *data.TrustSet, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertTrustSet(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	trustset := t.Transaction.(*data.TrustSet)
 	limit := NewAmount(&trustset.LimitAmount)
-	if err := limit.Lookup(db); err != nil {
+	if err := limit.Lookup(lookups); err != nil {
 		return err
 	}
 	_, err := tx.Exec(statements["InsertTrustSet"],
@@ -488,7 +680,8 @@ func (db *sqldb) insertTrustSet(trustset *data.TrustSet, t *data.TransactionWith
 	return err
 }
 
-func (db *sqldb) insertSetFee(setFee *data.SetFee, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertSetFee(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	setFee := t.Transaction.(*data.SetFee)
 	_, err := tx.Exec(statements["InsertSetFee"],
 		t.LedgerSequence,
 		t.MetaData.TransactionIndex,
@@ -500,7 +693,8 @@ func (db *sqldb) insertSetFee(setFee *data.SetFee, t *data.TransactionWithMetaDa
 	return err
 }
 
-func (db *sqldb) insertAmendment(amendment *data.Amendment, t *data.TransactionWithMetaData, tx *sql.Tx) error {
+func insertAmendment(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+	amendment := t.Transaction.(*data.Amendment)
 	_, err := tx.Exec(statements["InsertAmendment"],
 		t.LedgerSequence,
 		t.MetaData.TransactionIndex,
@@ -509,24 +703,73 @@ func (db *sqldb) insertAmendment(amendment *data.Amendment, t *data.TransactionW
 	return err
 }
 
+// InsertLookup stores item.Value if it is not already present and sets
+// item.Id to the Id the database holds for it. Ids are allocated by the
+// database so that several processes can insert into the same tables.
 func (db *sqldb) InsertLookup(stmnt string, item *LookupItem) error {
-	result, err := db.Exec(statements[stmnt], item.Id, item.Value, item.Human)
-	if err != nil {
+	return db.insertLookup(db.DB, stmnt, item)
+}
+
+func (db *sqldb) insertLookup(q queryer, stmnt string, item *LookupItem) error {
+	if err := db.writable(); err != nil {
 		return err
 	}
-	if n, _ := result.RowsAffected(); n > 1 {
-		return fmt.Errorf("Duplicate Lookup inserted: %s", item.Human, item.Id)
+	find, ok := lookupIds[stmnt]
+	if !ok {
+		return fmt.Errorf("Unknown lookup statement: %s", stmnt)
+	}
+	_, inTx := q.(*sql.Tx)
+	for attempt := 0; attempt < maxLookupAttempts; attempt++ {
+		_, err := q.Exec(statements[stmnt], item.Value, item.Human)
+		if err != nil && !retryable(err, inTx) {
+			return err
+		}
+		// Either we stored the value, a concurrent writer did, or
+		// another value took the Id we tried
+		err = q.QueryRow(statements[find], item.Value).Scan(&item.Id)
+		if err != sql.ErrNoRows {
+			return err
+		}
 	}
-	return nil
+	return fmt.Errorf("Could not allocate Id for %s", item.Human)
 }
 
-func (db *sqldb) GetLookups(stmnt string) ([]LookupItem, error) {
-	rows, err := db.DB.Query(statements[stmnt])
+func (db *sqldb) GetLookups(stmnt string, args ...interface{}) ([]LookupItem, error) {
+	rows, err := db.DB.Query(statements[stmnt], args...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanLookups(rows, nil)
+}
+
+// GetLookupValues returns the rows stored for ids, in no particular
+// order. Unknown ids are left out.
+func (db *sqldb) GetLookupValues(stmnt string, ids []uint32) ([]LookupItem, error) {
 	var items []LookupItem
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxLookupIds {
+			n = maxLookupIds
+		}
+		args := make([]interface{}, n)
+		for i, id := range ids[:n] {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", n), ",")
+		rows, err := db.DB.Query(fmt.Sprintf(statements[stmnt], placeholders), args...)
+		if err != nil {
+			return nil, err
+		}
+		if items, err = scanLookups(rows, items); err != nil {
+			return nil, err
+		}
+		ids = ids[n:]
+	}
+	return items, nil
+}
+
+func scanLookups(rows *sql.Rows, items []LookupItem) ([]LookupItem, error) {
+	defer rows.Close()
 	for rows.Next() {
 		var item LookupItem
 		if err := rows.Scan(&item.Id, &item.Value, &item.Human); err != nil {
@@ -534,13 +777,65 @@ func (db *sqldb) GetLookups(stmnt string) ([]LookupItem, error) {
 		}
 		items = append(items, item)
 	}
-	return items, nil
+	return items, rows.Err()
+}
+
+// GetLookupId sets item.Id to the Id stored for item.Value
+func (db *sqldb) GetLookupId(stmnt string, item *LookupItem) error {
+	return db.GetLookupIdContext(context.Background(), stmnt, item)
+}
+
+func (db *sqldb) GetLookupIdContext(ctx context.Context, stmnt string, item *LookupItem) error {
+	err := db.QueryRowContext(ctx, statements[stmnt], item.Value).Scan(&item.Id)
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// GetLookupValue sets item.Value and item.Human to those stored for item.Id
+func (db *sqldb) GetLookupValue(stmnt string, item *LookupItem) error {
+	var value []byte
+	err := db.QueryRow(statements[stmnt], item.Id).Scan(&value, &item.Human)
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+	item.Value = value
+	return err
 }
 
 func (db *sqldb) GetAccount(n uint32) *data.Account {
 	return db.accounts.Get(n)
 }
 
+func (db *sqldb) GetCurrency(n uint32) *data.Currency {
+	return db.currencies.Get(n)
+}
+
+func (db *sqldb) GetRegularKey(n uint32) *data.RegularKey {
+	return db.regularKeys.Get(n)
+}
+
+func (db *sqldb) GetPublicKey(n uint32) *data.PublicKey {
+	return db.publicKeys.Get(n)
+}
+
+func (db *sqldb) GetAccounts(ns []uint32) ([]*data.Account, error) {
+	return db.accounts.GetMany(ns)
+}
+
+func (db *sqldb) GetCurrencies(ns []uint32) ([]*data.Currency, error) {
+	return db.currencies.GetMany(ns)
+}
+
+func (db *sqldb) GetRegularKeys(ns []uint32) ([]*data.RegularKey, error) {
+	return db.regularKeys.GetMany(ns)
+}
+
+func (db *sqldb) GetPublicKeys(ns []uint32) ([]*data.PublicKey, error) {
+	return db.publicKeys.GetMany(ns)
+}
+
 func (db *sqldb) LookupAccount(a *data.Account) (uint32, error) {
 	return db.accounts.Lookup(a)
 }
@@ -557,8 +852,46 @@ func (db *sqldb) LookupPublicKey(p *data.PublicKey) (uint32, error) {
 	return db.publicKeys.Lookup(p)
 }
 
+// FindAccount returns the Id of a, or storage.ErrNotFound if a has
+// never been stored. Unlike LookupAccount it never writes.
+func (db *sqldb) FindAccount(a *data.Account) (uint32, error) {
+	return db.FindAccountContext(context.Background(), a)
+}
+
+func (db *sqldb) FindAccountContext(ctx context.Context, a *data.Account) (uint32, error) {
+	return db.accounts.FindContext(ctx, a)
+}
+
+func (db *sqldb) FindCurrency(c *data.Currency) (uint32, error) {
+	return db.currencies.Find(c)
+}
+
+func (db *sqldb) FindRegularKey(r *data.RegularKey) (uint32, error) {
+	return db.regularKeys.Find(r)
+}
+
+func (db *sqldb) FindPublicKey(p *data.PublicKey) (uint32, error) {
+	return db.publicKeys.Find(p)
+}
+
 func (db *sqldb) SearchAccounts(s string) ([]string, error) {
-	rows, err := db.DB.Query(`SELECT Human FROM Account WHERE Human LIKE ? ORDER BY Human LIMIT 10;`, "%"+s+"%")
+	return db.SearchAccountsContext(context.Background(), s)
+}
+
+// SearchAccountsContext returns up to ten accounts containing s. A
+// complete address is found by value rather than by pattern.
+func (db *sqldb) SearchAccountsContext(ctx context.Context, s string) ([]string, error) {
+	if account, err := data.NewAccountFromAddress(s); err == nil {
+		switch _, err := db.FindAccountContext(ctx, account); err {
+		case nil:
+			return []string{account.String()}, nil
+		case storage.ErrNotFound:
+			return []string{}, nil
+		default:
+			return nil, err
+		}
+	}
+	rows, err := db.reader().QueryContext(ctx, `SELECT Human FROM Account WHERE Human LIKE ? ORDER BY Human LIMIT 10;`, "%"+s+"%")
 	if err != nil {
 		return nil, err
 	}
@@ -571,28 +904,52 @@ func (db *sqldb) SearchAccounts(s string) ([]string, error) {
 		}
 		results = append(results, result)
 	}
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 	return results, nil
 }
 
 func (db *sqldb) Query(q Query, result *QueryResult) error {
-	tx, err := db.Begin()
+	return db.QueryContext(context.Background(), q, result)
+}
+
+// QueryContext runs q in a read only transaction that is rolled back
+// when ctx is done. Queries implementing ContextQuery are also passed
+// ctx for each statement they execute.
+func (db *sqldb) QueryContext(ctx context.Context, q Query, result *QueryResult) error {
+	tx, err := db.reader().BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
+	if cq, ok := q.(ContextQuery); ok {
+		return cq.RowsContext(ctx, tx, result)
+	}
 	return q.Rows(tx, result)
 }
 
 func (db *sqldb) Get(hash data.Hash256) (data.Storer, error) {
+	return db.GetContext(context.Background(), hash)
+}
+
+// GetContext rebuilds the ledger or transaction from its raw encoding
+// where stored, and from its columns otherwise.
+func (db *sqldb) GetContext(ctx context.Context, hash data.Hash256) (data.Storer, error) {
+	switch v, err := db.getRaw(ctx, hash); err {
+	case nil:
+		return v, nil
+	case storage.ErrNotFound:
+		break
+	default:
+		return nil, err
+	}
 	result := &QueryResult{}
-	query, err := NewTransactionQuery(db, map[string]string{"Hash": hash.String()})
+	query, err := NewTransactionQuery(db, map[string]string{"Hash": hash.String(), "Full": "true"})
 	if err != nil {
 		return nil, err
 	}
-	err = db.Query(query.LedgerQuery, result)
+	err = db.QueryContext(ctx, query.LedgerQuery, result)
 	switch {
 	case err == storage.ErrNotFound:
 		break
@@ -603,7 +960,7 @@ func (db *sqldb) Get(hash data.Hash256) (data.Storer, error) {
 	case len(result.Ledgers) == 1:
 		return result.Ledgers[0], nil
 	}
-	err = db.Query(query, result)
+	err = db.QueryContext(ctx, query, result)
 	switch {
 	case err != nil:
 		return nil, err
@@ -617,8 +974,34 @@ func (db *sqldb) Get(hash data.Hash256) (data.Storer, error) {
 }
 
 func (db *sqldb) MissingLedgers(start, end uint32) ([]uint32, error) {
+	return db.MissingLedgersContext(context.Background(), start, end)
+}
+
+func (db *sqldb) MissingLedgersContext(ctx context.Context, start, end uint32) ([]uint32, error) {
 	stmnt := "SELECT s.seq  FROM seq_%d_to_%d s LEFT OUTER JOIN Ledger l ON s.seq=l.LedgerSequence WHERE l.LedgerSequence IS NULL;"
-	rows, err := db.DB.Query(fmt.Sprintf(stmnt, start, end))
+	return db.missingLedgers(ctx, stmnt, start, end)
+}
+
+func (db *sqldb) MissingCompleteLedgers(start, end uint32) ([]uint32, error) {
+	stmnt := "SELECT s.seq  FROM seq_%d_to_%d s LEFT OUTER JOIN Ledger l ON s.seq=l.LedgerSequence WHERE l.LedgerSequence IS NULL OR NOT l.Complete;"
+	return db.missingLedgers(context.Background(), stmnt, start, end)
+}
+
+// missingLedgers does not report ledgers removed by a retention policy
+func (db *sqldb) missingLedgers(ctx context.Context, stmnt string, start, end uint32) ([]uint32, error) {
+	// Both queries go to the same server, so they see the same prune
+	reader := db.reader()
+	prunedBefore, err := readPrunedBefore(ctx, reader)
+	if err != nil {
+		return nil, err
+	}
+	if start < prunedBefore {
+		start = prunedBefore
+	}
+	if start > end {
+		return nil, nil
+	}
+	rows, err := reader.QueryContext(ctx, fmt.Sprintf(stmnt, start, end))
 	if err != nil {
 		return nil, err
 	}
@@ -635,16 +1018,7 @@ func (db *sqldb) MissingLedgers(start, end uint32) ([]uint32, error) {
 }
 
 func (db *sqldb) Stats() string {
-	return ""
+	return db.replicaStats()
 }
 
 func (db *sqldb) Ledger() (*data.LedgerSet, error) { return nil, nil }
-
-func (db *sqldb) execSchema() error {
-	for _, sql := range schema {
-		if _, err := db.Exec(sql); err != nil {
-			return fmt.Errorf("%s\n%s", err, sql)
-		}
-	}
-	return nil
-}
@@ -0,0 +1,284 @@
+package mysql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	gomysql "github.com/go-sql-driver/mysql"
+	"time"
+)
+
+const markerTable = "RippleMarker"
+
+var ErrReadOnly = errors.New("Database is read only")
+
+type LookupCachePolicy int
+
+const (
+	// Every lookup table is loaded when the database is opened
+	LookupCacheFull LookupCachePolicy = iota
+	// Each lookup table is loaded the first time it is used
+	LookupCacheLazy
+	// Each lookup table keeps at most Options.LookupCacheSize recently
+	// used rows and reads others from the database as they are needed
+	LookupCacheBounded
+)
+
+type Options struct {
+	DSN string
+	// Read only copies of DSN used for queries
+	Replicas []string
+	// Replicas further than this many ledgers behind the primary are
+	// not queried. Zero disables the check.
+	MaxReplicaLag uint32
+	// How long the lag measured for a replica is trusted. Defaults to
+	// one second.
+	ReplicaLagTTL time.Duration
+	// Database to use in place of the one named in DSN. It is created
+	// if it does not exist.
+	Schema string
+	// Prepended to the name of every table and view, so that several
+	// archives can share one database
+	TablePrefix     string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	Timeout         time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	// Refuse all writes and never migrate the schema
+	ReadOnly bool
+	// Apply pending migrations when the database is opened. Otherwise
+	// opening fails while any are pending, unless this package has
+	// just created the database.
+	Migrate       bool
+	InsertMode    InsertMode
+	PartitionSize uint32
+	LookupCache   LookupCachePolicy
+	// Rows kept by each lookup table with LookupCacheBounded
+	LookupCacheSize int
+	// File written by WriteLookupSnapshot. Only the lookup rows added
+	// since it was written are read when the database is opened. A
+	// snapshot of another archive, or of this one before a Reset, is
+	// ignored.
+	LookupSnapshot string
+	// Drop and recreate the database. This is refused unless the
+	// database is empty or was created by this package.
+	Reset bool
+}
+
+func (opts *Options) config(dsn string) (*gomysql.Config, error) {
+	cfg, err := gomysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Schema != "" {
+		cfg.DBName = opts.Schema
+	}
+	if cfg.DBName == "" {
+		return nil, fmt.Errorf("No database selected")
+	}
+	if opts.Timeout > 0 {
+		cfg.Timeout = opts.Timeout
+	}
+	if opts.ReadTimeout > 0 {
+		cfg.ReadTimeout = opts.ReadTimeout
+	}
+	if opts.WriteTimeout > 0 {
+		cfg.WriteTimeout = opts.WriteTimeout
+	}
+	return cfg, nil
+}
+
+func (opts *Options) open(cfg *gomysql.Config) (*sql.DB, error) {
+	var db *sql.DB
+	if opts.TablePrefix != "" {
+		db = sql.OpenDB(&prefixConnector{&gomysql.MySQLDriver{}, cfg.FormatDSN(), opts.TablePrefix, tableNames()})
+	} else {
+		var err error
+		if db, err = sql.Open("mysql", cfg.FormatDSN()); err != nil {
+			return nil, err
+		}
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	return db, nil
+}
+
+func NewMySqlDBWithOptions(opts Options) (IndexedDB, error) {
+	cfg, err := opts.config(opts.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ReadOnly && opts.Reset {
+		return nil, fmt.Errorf("Cannot reset a read only database")
+	}
+	var created bool
+	if !opts.ReadOnly {
+		if created, err = prepareDatabase(*cfg, opts.TablePrefix, opts.Reset); err != nil {
+			return nil, err
+		}
+	}
+	inner, err := opts.open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := &sqldb{
+		DB:         inner,
+		name:       cfg.DBName,
+		prefix:     opts.TablePrefix,
+		mode:       int32(opts.InsertMode),
+		readOnly:   opts.ReadOnly,
+		replicaLag: opts.MaxReplicaLag,
+	}
+	if db.replicaLagTTL = opts.ReplicaLagTTL; db.replicaLagTTL == 0 {
+		db.replicaLagTTL = defaultReplicaLagTTL
+	}
+	for _, dsn := range opts.Replicas {
+		replicaCfg, err := opts.config(dsn)
+		if err != nil {
+			return nil, err
+		}
+		secondary, err := opts.open(replicaCfg)
+		if err != nil {
+			return nil, err
+		}
+		db.replicas = append(db.replicas, &replica{DB: secondary})
+	}
+	if created || opts.Migrate {
+		err = db.Migrate()
+	} else {
+		err = db.checkMigrated()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.loadPartitions(); err != nil {
+		return nil, err
+	}
+	if opts.PartitionSize > 0 && !opts.ReadOnly {
+		if err := db.EnablePartitioning(opts.PartitionSize); err != nil {
+			return nil, err
+		}
+	}
+	identity, err := db.identity()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := readLookupSnapshot(opts.LookupSnapshot, identity)
+	if err != nil {
+		return nil, err
+	}
+	cfg := lookupConfig{opts.LookupCache, opts.LookupCacheSize, snapshot}
+	if db.accounts, err = newAddressLookup(db, cfg); err != nil {
+		return nil, err
+	}
+	if db.regularKeys, err = newRegularKeyLookup(db, cfg); err != nil {
+		return nil, err
+	}
+	if db.publicKeys, err = newPublicKeyLookup(db, cfg); err != nil {
+		return nil, err
+	}
+	if db.currencies, err = newCurrencyLookup(db, cfg); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// prepareDatabase creates the database named in cfg if it does not
+// exist. When it holds no tables with prefix, the marker table is
+// created and prepareDatabase reports that the archive is new. With
+// reset set, an archive carrying the marker table is first dropped: the
+// whole database without a prefix, otherwise only the prefixed tables.
+func prepareDatabase(cfg gomysql.Config, prefix string, reset bool) (bool, error) {
+	name := cfg.DBName
+	cfg.DBName = ""
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	var exists, tables, markers int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME=?;`, name).Scan(&exists); err != nil {
+		return false, err
+	}
+	err = db.QueryRow(`SELECT COUNT(*),COALESCE(SUM(TABLE_NAME=?),0) FROM information_schema.TABLES WHERE TABLE_SCHEMA=? AND LEFT(TABLE_NAME,?)=?;`, prefix+markerTable, name, len(prefix), prefix).Scan(&tables, &markers)
+	if err != nil {
+		return false, err
+	}
+	if reset && tables > 0 {
+		if markers == 0 {
+			return false, fmt.Errorf("Refusing to drop database %s which was not created by this package", name)
+		}
+		if err := dropArchive(db, name, prefix); err != nil {
+			return false, err
+		}
+		exists, tables = 0, 0
+		if prefix != "" {
+			exists = 1
+		}
+	}
+	if exists == 0 {
+		if _, err := db.Exec("CREATE DATABASE `" + name + "`;"); err != nil {
+			return false, err
+		}
+	}
+	if tables > 0 {
+		return false, nil
+	}
+	marker := "`" + name + "`.`" + prefix + markerTable + "`"
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + marker + " (Created DATETIME NOT NULL);"); err != nil {
+		return false, err
+	}
+	_, err = db.Exec("INSERT INTO " + marker + " VALUES(NOW());")
+	return err == nil, err
+}
+
+// dropArchive drops the database name, or only its tables and views
+// starting with prefix
+func dropArchive(db *sql.DB, name, prefix string) error {
+	if prefix == "" {
+		_, err := db.Exec("DROP DATABASE `" + name + "`;")
+		return err
+	}
+	rows, err := db.Query(`SELECT TABLE_NAME,TABLE_TYPE='VIEW' FROM information_schema.TABLES WHERE TABLE_SCHEMA=? AND LEFT(TABLE_NAME,?)=?;`, name, len(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	var drop []string
+	for rows.Next() {
+		var (
+			table string
+			view  bool
+		)
+		if err := rows.Scan(&table, &view); err != nil {
+			rows.Close()
+			return err
+		}
+		kind := "TABLE"
+		if view {
+			kind = "VIEW"
+		}
+		drop = append(drop, "DROP "+kind+" `"+name+"`.`"+table+"`;")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, stmnt := range drop {
+		if _, err := db.Exec(stmnt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *sqldb) writable() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
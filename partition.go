@@ -0,0 +1,194 @@
+package mysql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// partitionsAhead is how many partitions beyond the current ledger are
+// added at once, so that the DDL runs rarely rather than at every
+// partition boundary.
+const partitionsAhead = 16
+
+type partition struct {
+	Name         string
+	Lower, Upper uint64
+	MaxValue     bool
+}
+
+// EnablePartitioning converts every table keyed by LedgerSequence into
+// a table RANGE partitioned by LedgerSequence with size ledgers in each
+// partition. Tables that are already partitioned are left alone.
+// Partitions are added as ingestion moves forward and ledger ranges
+// covering whole partitions are deleted by dropping them.
+func (db *sqldb) EnablePartitioning(size uint32) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("Invalid partition size")
+	}
+	db.partitionMu.Lock()
+	defer db.partitionMu.Unlock()
+	for _, table := range ledgerTables {
+		partitions, err := db.partitions(table)
+		if err != nil {
+			return err
+		}
+		if len(partitions) > 0 {
+			continue
+		}
+		var max uint64
+		if err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(LedgerSequence),0) FROM %s;", table)).Scan(&max); err != nil {
+			return err
+		}
+		var defs []string
+		for lower := uint64(0); lower <= max+uint64(size); lower += uint64(size) {
+			defs = append(defs, partitionDefinition(lower, lower+uint64(size)))
+		}
+		stmnt := fmt.Sprintf("ALTER TABLE %s PARTITION BY RANGE (LedgerSequence) (%s);", table, strings.Join(defs, ","))
+		if _, err := db.Exec(stmnt); err != nil {
+			return fmt.Errorf("%s\n%s", err, stmnt)
+		}
+	}
+	return db.loadPartitions()
+}
+
+func partitionDefinition(lower, upper uint64) string {
+	return fmt.Sprintf("PARTITION p%d VALUES LESS THAN (%d)", lower, upper)
+}
+
+func (db *sqldb) partitions(table string) ([]partition, error) {
+	rows, err := db.DB.Query(`SELECT PARTITION_NAME,PARTITION_DESCRIPTION FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND PARTITION_NAME IS NOT NULL ORDER BY PARTITION_ORDINAL_POSITION;`, db.prefix+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		partitions []partition
+		lower      uint64
+	)
+	for rows.Next() {
+		var name, description string
+		if err := rows.Scan(&name, &description); err != nil {
+			return nil, err
+		}
+		if description == "MAXVALUE" {
+			partitions = append(partitions, partition{name, lower, math.MaxUint64, true})
+			continue
+		}
+		upper, err := strconv.ParseUint(description, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unsupported partition %s.%s: %s", table, name, description)
+		}
+		partitions = append(partitions, partition{name, lower, upper, false})
+		lower = upper
+	}
+	return partitions, rows.Err()
+}
+
+// loadPartitions records the partition size, the upper bound of the
+// last bounded partition and any MAXVALUE partition of every partitioned
+// table. Callers hold partitionMu.
+func (db *sqldb) loadPartitions() error {
+	db.partitionSize = 0
+	db.partitionBounds = make(map[string]uint64)
+	db.partitionMaxValues = make(map[string]string)
+	for _, table := range ledgerTables {
+		partitions, err := db.partitions(table)
+		if err != nil {
+			return err
+		}
+		if n := len(partitions); n > 0 && partitions[n-1].MaxValue {
+			db.partitionMaxValues[table] = partitions[n-1].Name
+			partitions = partitions[:n-1]
+		}
+		if len(partitions) == 0 {
+			continue
+		}
+		if db.partitionSize == 0 {
+			db.partitionSize = partitions[0].Upper
+		}
+		db.partitionBounds[table] = partitions[len(partitions)-1].Upper
+	}
+	return nil
+}
+
+// ensurePartitions adds partitions to every partitioned table once
+// ledgerSequence comes within one partition of its last bound, taking
+// it partitionsAhead partitions beyond ledgerSequence. A MAXVALUE
+// partition is split with REORGANIZE PARTITION. It runs DDL, so must
+// not be called with a transaction open.
+func (db *sqldb) ensurePartitions(ledgerSequence uint32) error {
+	db.partitionMu.Lock()
+	defer db.partitionMu.Unlock()
+	if db.partitionSize == 0 {
+		return nil
+	}
+	for table, upper := range db.partitionBounds {
+		if upper > uint64(ledgerSequence)+db.partitionSize {
+			continue
+		}
+		var defs []string
+		for ; upper <= uint64(ledgerSequence)+partitionsAhead*db.partitionSize; upper += db.partitionSize {
+			defs = append(defs, partitionDefinition(upper, upper+db.partitionSize))
+		}
+		stmnt := fmt.Sprintf("ALTER TABLE %s ADD PARTITION (%s);", table, strings.Join(defs, ","))
+		if name, ok := db.partitionMaxValues[table]; ok {
+			defs = append(defs, fmt.Sprintf("PARTITION %s VALUES LESS THAN MAXVALUE", name))
+			stmnt = fmt.Sprintf("ALTER TABLE %s REORGANIZE PARTITION %s INTO (%s);", table, name, strings.Join(defs, ","))
+		}
+		if _, err := db.Exec(stmnt); err != nil {
+			return fmt.Errorf("%s\n%s", err, stmnt)
+		}
+		db.partitionBounds[table] = upper
+	}
+	return nil
+}
+
+func (db *sqldb) partitionsNeeded(ledgerSequence uint32) bool {
+	db.partitionMu.Lock()
+	defer db.partitionMu.Unlock()
+	for _, upper := range db.partitionBounds {
+		if upper <= uint64(ledgerSequence)+db.partitionSize {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteLedgerRange drops the partitions of table lying wholly within
+// start and end and deletes the remaining rows in chunks. The first
+// partition is never dropped, as MySQL will not remove every partition.
+func (db *sqldb) deleteLedgerRange(table string, start, end uint32) error {
+	db.partitionMu.Lock()
+	_, partitioned := db.partitionBounds[table]
+	db.partitionMu.Unlock()
+	if partitioned {
+		partitions, err := db.partitions(table)
+		if err != nil {
+			return err
+		}
+		var drop []string
+		for i, p := range partitions {
+			if i > 0 && p.Lower >= uint64(start) && p.Upper-1 <= uint64(end) {
+				drop = append(drop, p.Name)
+			}
+		}
+		if len(drop) > 0 {
+			stmnt := fmt.Sprintf("ALTER TABLE %s DROP PARTITION %s;", table, strings.Join(drop, ","))
+			if _, err := db.Exec(stmnt); err != nil {
+				return fmt.Errorf("%s\n%s", err, stmnt)
+			}
+			db.partitionMu.Lock()
+			err := db.loadPartitions()
+			db.partitionMu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return db.deleteRange(table, start, end)
+}
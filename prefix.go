@@ -0,0 +1,182 @@
+package mysql
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+)
+
+var createTable = regexp.MustCompile(`(?i)CREATE\s+(?:OR\s+REPLACE\s+)?(?:TABLE|VIEW)\s+(?:IF\s+NOT\s+EXISTS\s+)?(\w+)`)
+
+// tableNames returns every table and view created by the migrations and
+// the registered handlers.
+func tableNames() map[string]bool {
+	names := map[string]bool{markerTable: true}
+	add := func(stmnts []string) {
+		for _, stmnt := range stmnts {
+			for _, match := range createTable.FindAllStringSubmatch(stmnt, -1) {
+				names[match[1]] = true
+			}
+		}
+	}
+	add([]string{schemaVersion})
+	for _, m := range migrations {
+		add(m.Statements)
+	}
+	for _, handler := range transactionHandlers {
+		add(handler.Schema)
+	}
+	for _, handler := range ledgerEntryHandlers {
+		add(handler.Schema)
+	}
+	return names
+}
+
+func isWord(ch byte) bool {
+	return ch == '_' || ch == '$' || ch >= '0' && ch <= '9' || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z'
+}
+
+// prefixTables renames each of tables in query that follows FROM, JOIN,
+// INTO, UPDATE, TABLE, VIEW or LIKE, or that qualifies a column, so that
+// column names matching a table are left alone. Quoted text is not
+// renamed.
+func prefixTables(query, prefix string, tables map[string]bool) string {
+	var (
+		out    strings.Builder
+		expect bool
+	)
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			j := i + 1
+			for ; j < len(query) && query[j] != ch; j++ {
+				if query[j] == '\\' && j+1 < len(query) {
+					j++
+				}
+			}
+			if j < len(query) {
+				j++
+			}
+			out.WriteString(query[i:j])
+			i, expect = j, false
+		case isWord(ch):
+			j := i
+			for j < len(query) && isWord(query[j]) {
+				j++
+			}
+			word := query[i:j]
+			qualifier := j < len(query) && query[j] == '.'
+			if tables[word] && (expect || qualifier) {
+				out.WriteString(prefix)
+			}
+			out.WriteString(word)
+			switch strings.ToUpper(word) {
+			case "FROM", "JOIN", "INTO", "UPDATE", "TABLE", "VIEW", "LIKE":
+				expect = true
+			case "IF", "NOT", "EXISTS":
+			default:
+				expect = expect && qualifier
+			}
+			i = j
+		default:
+			out.WriteByte(ch)
+			if ch != '.' && ch != ' ' && ch != '\t' && ch != '\n' && ch != '\r' {
+				expect = false
+			}
+			i++
+		}
+	}
+	return out.String()
+}
+
+// prefixConnector opens connections that rename the tables of this
+// package in every statement with a prefix.
+type prefixConnector struct {
+	driver driver.Driver
+	dsn    string
+	prefix string
+	tables map[string]bool
+}
+
+func (c *prefixConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &prefixConn{conn, c}, nil
+}
+
+func (c *prefixConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type prefixConn struct {
+	driver.Conn
+	connector *prefixConnector
+}
+
+func (c *prefixConn) rename(query string) string {
+	return prefixTables(query, c.connector.prefix, c.connector.tables)
+}
+
+func (c *prefixConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(c.rename(query))
+}
+
+func (c *prefixConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, c.rename(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c *prefixConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *prefixConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, c.rename(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *prefixConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, c.rename(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *prefixConn) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+func (c *prefixConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *prefixConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *prefixConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
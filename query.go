@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/rubblelabs/ripple/data"
@@ -11,17 +12,6 @@ import (
 	"time"
 )
 
-var txTypes = map[string]data.TransactionType{
-	"payment":       data.PAYMENT,
-	"accountset":    data.ACCOUNT_SET,
-	"setregularkey": data.SET_REGULAR_KEY,
-	"offercreate":   data.OFFER_CREATE,
-	"offercancel":   data.OFFER_CANCEL,
-	"trustset":      data.TRUST_SET,
-	"amendment":     data.AMENDMENT,
-	"setfee":        data.SET_FEE,
-}
-
 type LedgerQuery struct {
 	Hash      *data.Hash256 `json:",omitempty"`
 	Ledger    *uint32       `json:",omitempty"`
@@ -35,7 +25,10 @@ type TransactionQuery struct {
 	AccountId       *uint32               `json:",omitempty"`
 	DestinationId   *uint32               `json:",omitempty"`
 	TransactionType *data.TransactionType `json:",omitempty"`
-	Limit           uint32                `json:",omitempty"`
+	Complete        bool                  `json:",omitempty"`
+	// Full returns transactions with their paths, memos and metadata
+	Full  bool   `json:",omitempty"`
+	Limit uint32 `json:",omitempty"`
 }
 
 type TransactionRow struct {
@@ -59,8 +52,12 @@ type QueryResult struct {
 }
 
 func (result *QueryResult) ExecuteQuery(tx *sql.Tx, query string, params []interface{}) (*sql.Rows, error) {
+	return result.ExecuteQueryContext(context.Background(), tx, query, params)
+}
+
+func (result *QueryResult) ExecuteQueryContext(ctx context.Context, tx *sql.Tx, query string, params []interface{}) (*sql.Rows, error) {
 	start := time.Now()
-	rows, err := tx.Query(query, params...)
+	rows, err := tx.QueryContext(ctx, query, params...)
 	result.Queries = append(result.Queries, QueryExecution{time.Since(start), query, params})
 	return rows, err
 }
@@ -113,6 +110,8 @@ func (q *TransactionQuery) Clone() *TransactionQuery {
 		AccountId:       q.AccountId,
 		DestinationId:   q.DestinationId,
 		TransactionType: q.TransactionType,
+		Complete:        q.Complete,
+		Full:            q.Full,
 		Limit:           q.Limit,
 	}
 }
@@ -148,16 +147,32 @@ func NewTransactionQuery(db IndexedDB, params map[string]string) (*TransactionQu
 		v := uint32(maxLedger)
 		q.MaxLedger = &v
 	}
-	if txType, ok := txTypes[strings.ToLower(params["TransactionType"])]; ok {
+	if name, ok := params["TransactionType"]; ok {
+		txType, ok := transactionType(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown Transaction type: %s", name)
+		}
 		q.TransactionType = &txType
 	}
+	if complete, ok := params["Complete"]; ok {
+		if q.Complete, err = strconv.ParseBool(complete); err != nil {
+			return nil, err
+		}
+	}
+	if full, ok := params["Full"]; ok {
+		if q.Full, err = strconv.ParseBool(full); err != nil {
+			return nil, err
+		}
+	}
 	if account, ok := params["Account"]; ok {
 		q.Account, err = data.NewAccountFromAddress(account)
 		if err != nil {
 			return nil, fmt.Errorf("Bad Account: %s", account)
 		}
-		if accountId, err := db.LookupAccount(q.Account); err != nil {
+		if accountId, err := db.FindAccount(q.Account); err == storage.ErrNotFound {
 			return nil, fmt.Errorf("Account does not exist: %s", account)
+		} else if err != nil {
+			return nil, err
 		} else {
 			q.AccountId = &accountId
 			// q.DestinationId = &accountId
@@ -171,20 +186,24 @@ func NewTransactionQuery(db IndexedDB, params map[string]string) (*TransactionQu
 	return q, nil
 }
 
-func getLedgerRange(tx *sql.Tx, result *QueryResult) error {
+func getLedgerRange(ctx context.Context, tx *sql.Tx, result *QueryResult) error {
 	if result.First == 0 && result.Last == 0 {
-		return tx.QueryRow(queries["GetLedgerRange"]).Scan(&result.First, &result.Last)
+		return tx.QueryRowContext(ctx, queries["GetLedgerRange"]).Scan(&result.First, &result.Last)
 	}
 	return nil
 }
 
 func (q *LedgerQuery) Rows(tx *sql.Tx, result *QueryResult) error {
+	return q.RowsContext(context.Background(), tx, result)
+}
+
+func (q *LedgerQuery) RowsContext(ctx context.Context, tx *sql.Tx, result *QueryResult) error {
 	result.Query.LedgerQuery = q.Clone()
-	if err := getLedgerRange(tx, result); err != nil {
+	if err := getLedgerRange(ctx, tx, result); err != nil {
 		return err
 	}
 	var predicates []interface{}
-	subQuery := `SELECT * FROM Ledger WHERE `
+	subQuery := `SELECT ` + ledgerColumns + ` FROM Ledger WHERE `
 	switch {
 	case q.Hash != nil:
 		subQuery += `Hash=? `
@@ -202,7 +221,7 @@ func (q *LedgerQuery) Rows(tx *sql.Tx, result *QueryResult) error {
 		return fmt.Errorf("Invalid Query: %+v", q)
 	}
 	sql := fmt.Sprintf("SELECT * FROM (%s LIMIT 10)l ORDER BY LedgerSequence;", subQuery)
-	rows, err := result.ExecuteQuery(tx, sql, predicates)
+	rows, err := result.ExecuteQueryContext(ctx, tx, sql, predicates)
 	if err != nil {
 		return err
 	}
@@ -256,12 +275,19 @@ func (q *TransactionQuery) Where() (string, string, []interface{}) {
 		where = append(where, `Account=?`)
 		predicates = append(predicates, q.AccountId)
 	}
+	if q.Complete {
+		where = append(where, `LedgerSequence IN (SELECT LedgerSequence FROM Ledger WHERE Complete)`)
+	}
 	return strings.Join(where, " AND "), order, predicates
 }
 
 func (q *TransactionQuery) Rows(tx *sql.Tx, result *QueryResult) error {
+	return q.RowsContext(context.Background(), tx, result)
+}
+
+func (q *TransactionQuery) RowsContext(ctx context.Context, tx *sql.Tx, result *QueryResult) error {
 	result.Query = *q
-	if err := getLedgerRange(tx, result); err != nil {
+	if err := getLedgerRange(ctx, tx, result); err != nil {
 		return err
 	}
 	var (
@@ -270,7 +296,7 @@ func (q *TransactionQuery) Rows(tx *sql.Tx, result *QueryResult) error {
 	where, order, predicates := q.Where()
 	subQuery := fmt.Sprintf("SELECT LedgerSequence,TransactionIndex,TransactionType FROM Transaction WHERE %s %s", where, order)
 	ranges := fmt.Sprintf("SELECT TransactionType,MIN(LedgerSequence),MAX(LedgerSequence) FROM (%s LIMIT ?)t GROUP BY TransactionType ", subQuery)
-	rows, err := result.ExecuteQuery(tx, ranges, append(predicates, q.Limit))
+	rows, err := result.ExecuteQueryContext(ctx, tx, ranges, append(predicates, q.Limit))
 	if err != nil {
 		return err
 	}
@@ -290,9 +316,14 @@ func (q *TransactionQuery) Rows(tx *sql.Tx, result *QueryResult) error {
 		return rows.Err()
 	}
 	for _, txQuery := range txQueries {
+		// Types without a handler only have the columns of TransactionView
+		view := "TransactionView"
+		if handler, ok := transactionHandlers[*txQuery.TransactionType]; ok {
+			view = handler.View
+		}
 		where, _, predicates := txQuery.Where()
-		sql := fmt.Sprintf("SELECT v.* FROM %sView v WHERE %s", txQuery.TransactionType, where)
-		rows, err := result.ExecuteQuery(tx, sql, predicates)
+		sql := fmt.Sprintf("SELECT v.* FROM %s v WHERE %s", view, where)
+		rows, err := result.ExecuteQueryContext(ctx, tx, sql, predicates)
 		if err != nil {
 			return err
 		}
@@ -310,6 +341,165 @@ func (q *TransactionQuery) Rows(tx *sql.Tx, result *QueryResult) error {
 			return rows.Err()
 		}
 	}
+	if q.Full {
+		for _, txm := range result.Transactions {
+			if err := fillTransaction(ctx, tx, result, txm); err != nil {
+				return err
+			}
+		}
+	}
 	// result.Transactions.Sort()
 	return nil
 }
+
+// fillTransaction replaces txm with the transaction decoded from its Raw
+// column. Rows stored before that column was added get their memos,
+// paths and AffectedNodes from the Memo, Path and ledger entry tables.
+func fillTransaction(ctx context.Context, tx *sql.Tx, result *QueryResult, txm *TransactionRow) error {
+	key := []interface{}{txm.LedgerSequence, txm.MetaData.TransactionIndex}
+	var raw []byte
+	if err := tx.QueryRowContext(ctx, queries["GetRawTransaction"], key...).Scan(&raw); err != nil {
+		return err
+	}
+	if raw != nil {
+		node, err := readRaw(txm.LedgerSequence, data.NT_TRANSACTION_NODE, data.HP_TRANSACTION_NODE, raw)
+		if err != nil {
+			return err
+		}
+		decoded, ok := node.(*data.TransactionWithMetaData)
+		if !ok {
+			return fmt.Errorf("Raw column of %s holds %T", txm.GetBase().Hash, node)
+		}
+		txm.TransactionWithMetaData = decoded
+		return nil
+	}
+	if err := fillMemos(ctx, tx, result, txm, key); err != nil {
+		return err
+	}
+	if err := fillAffectedNodes(ctx, tx, result, txm, key); err != nil {
+		return err
+	}
+	if payment, ok := txm.Transaction.(*data.Payment); ok {
+		return fillPaths(ctx, tx, result, payment, key)
+	}
+	return nil
+}
+
+func fillMemos(ctx context.Context, tx *sql.Tx, result *QueryResult, txm *TransactionRow, key []interface{}) error {
+	rows, err := result.ExecuteQueryContext(ctx, tx, queries["GetMemos"], key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	base := txm.GetBase()
+	for rows.Next() {
+		var (
+			memo               data.Memo
+			memoType, memoData []byte
+		)
+		if err := rows.Scan(&memoType, &memoData); err != nil {
+			return err
+		}
+		memo.Memo.MemoType = data.VariableLength(memoType)
+		memo.Memo.MemoData = data.VariableLength(memoData)
+		base.Memos = append(base.Memos, memo)
+	}
+	return rows.Err()
+}
+
+// fillAffectedNodes rebuilds the AffectedNodes of txm from the
+// LedgerEntry table and the tables of the ledger entry handlers. Fields
+// that are not stored, such as PreviousTxnLgrSeq, are left unset.
+func fillAffectedNodes(ctx context.Context, tx *sql.Tx, result *QueryResult, txm *TransactionRow, key []interface{}) error {
+	type entry struct {
+		pos   int
+		state data.LedgerEntryState
+		node  *data.AffectedNode
+	}
+	rows, err := result.ExecuteQueryContext(ctx, tx, queries["GetLedgerEntries"], key)
+	if err != nil {
+		return err
+	}
+	var entries []entry
+	for rows.Next() {
+		e := entry{node: new(data.AffectedNode)}
+		if err := rows.Scan(&e.pos, &e.node.LedgerEntryType, &e.state, NullBytes{&e.node.LedgerIndex}, NullBytes{&e.node.PreviousTxnID}); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// The rows of each node are read once the entries are closed, as a
+	// connection reads one result at a time
+	for _, e := range entries {
+		var current, previous data.LedgerEntry
+		if handler, ok := ledgerEntryHandlers[e.node.LedgerEntryType]; ok && handler.Read != nil {
+			row := tx.QueryRowContext(ctx, handler.Select, txm.LedgerSequence, txm.MetaData.TransactionIndex, e.pos)
+			switch current, previous, err = handler.Read(row); err {
+			case nil, sql.ErrNoRows:
+			default:
+				return err
+			}
+		}
+		var effect data.NodeEffect
+		switch e.state {
+		case data.Created:
+			e.node.NewFields = current
+			effect.CreatedNode = e.node
+		case data.Deleted:
+			e.node.FinalFields, e.node.PreviousFields = current, previous
+			effect.DeletedNode = e.node
+		default:
+			e.node.FinalFields, e.node.PreviousFields = current, previous
+			effect.ModifiedNode = e.node
+		}
+		txm.MetaData.AffectedNodes = append(txm.MetaData.AffectedNodes, effect)
+	}
+	return nil
+}
+
+func fillPaths(ctx context.Context, tx *sql.Tx, result *QueryResult, payment *data.Payment, key []interface{}) error {
+	rows, err := result.ExecuteQueryContext(ctx, tx, queries["GetPaths"], key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var paths data.PathSet
+	for rows.Next() {
+		var (
+			pathSet                   int
+			account, currency, issuer []byte
+			elem                      data.PathElem
+		)
+		if err := rows.Scan(&pathSet, &account, &currency, &issuer); err != nil {
+			return err
+		}
+		if account != nil {
+			elem.Account = new(data.Account)
+			copy(elem.Account[:], account)
+		}
+		if currency != nil {
+			elem.Currency = new(data.Currency)
+			copy(elem.Currency[:], currency)
+		}
+		if issuer != nil {
+			elem.Issuer = new(data.Account)
+			copy(elem.Issuer[:], issuer)
+		}
+		for len(paths) <= pathSet {
+			paths = append(paths, data.Path{})
+		}
+		paths[pathSet] = append(paths[pathSet], elem)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	if len(paths) > 0 {
+		payment.Paths = &paths
+	}
+	return nil
+}
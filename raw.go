@@ -0,0 +1,73 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/binary"
+	"github.com/rubblelabs/ripple/data"
+	"github.com/rubblelabs/ripple/storage"
+)
+
+// rawHeaderSize is the length of the node store header, two ledger
+// sequences, a NodeType and a HashPrefix, which Raw columns omit.
+const rawHeaderSize = 13
+
+// rawTables are searched in order by Get
+var rawTables = []struct {
+	stmnt  string
+	typ    data.NodeType
+	prefix data.HashPrefix
+}{
+	{"GetLedgerRaw", data.NT_LEDGER, data.HP_LEDGER_MASTER},
+	{"GetTransactionRaw", data.NT_TRANSACTION_NODE, data.HP_TRANSACTION_NODE},
+}
+
+// rawNode returns the canonical encoding of v stored in Raw columns
+func rawNode(v data.Storer) ([]byte, error) {
+	_, node, err := data.Node(v)
+	if err != nil {
+		return nil, err
+	}
+	return node[rawHeaderSize:], nil
+}
+
+// readRaw decodes a Raw column. The node id is the hash of the prefix
+// and the encoding, as it is for the ledger and transaction SHAMaps.
+func readRaw(ledgerSequence uint32, typ data.NodeType, prefix data.HashPrefix, raw []byte) (data.Storer, error) {
+	hasher := sha512.New()
+	hasher.Write(prefix.Bytes())
+	hasher.Write(raw)
+	var nodeId data.Hash256
+	copy(nodeId[:], hasher.Sum(nil))
+	node := new(bytes.Buffer)
+	binary.Write(node, binary.BigEndian, ledgerSequence)
+	binary.Write(node, binary.BigEndian, ledgerSequence)
+	node.WriteByte(byte(typ))
+	node.Write(prefix.Bytes())
+	node.Write(raw)
+	return data.ReadPrefix(bytes.NewReader(node.Bytes()), nodeId)
+}
+
+// getRaw rebuilds the ledger or transaction with hash from its Raw
+// column. Rows stored before the column was added are not found.
+func (db *sqldb) getRaw(ctx context.Context, hash data.Hash256) (data.Storer, error) {
+	for _, table := range rawTables {
+		var (
+			ledgerSequence uint32
+			raw            []byte
+		)
+		err := db.reader().QueryRowContext(ctx, statements[table.stmnt], hash.Bytes()).Scan(&ledgerSequence, &raw)
+		switch {
+		case err == sql.ErrNoRows:
+			continue
+		case err != nil:
+			return nil, err
+		case raw == nil:
+			continue
+		}
+		return readRaw(ledgerSequence, table.typ, table.prefix, raw)
+	}
+	return nil, storage.ErrNotFound
+}
@@ -0,0 +1,83 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReplicaLagTTL = time.Second
+
+// replica is a read only copy of the primary. Whether it is within the
+// allowed lag is measured at most once per replicaLagTTL.
+type replica struct {
+	*sql.DB
+	mu       sync.Mutex
+	checked  time.Time
+	caughtUp bool
+	errors   uint64
+	err      error
+}
+
+// reader returns a replica to query, rotating between those that are
+// reachable and within the allowed lag, or the primary if there are none.
+func (db *sqldb) reader() *sql.DB {
+	n := uint32(len(db.replicas))
+	if n == 0 {
+		return db.DB
+	}
+	next := atomic.AddUint32(&db.nextReplica, 1)
+	for i := uint32(0); i < n; i++ {
+		replica := db.replicas[(next+i)%n]
+		if db.caughtUp(replica) {
+			return replica.DB
+		}
+	}
+	return db.DB
+}
+
+func (db *sqldb) caughtUp(r *replica) bool {
+	if db.replicaLag == 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < db.replicaLagTTL {
+		return r.caughtUp
+	}
+	r.checked, r.caughtUp = time.Now(), false
+	var primary, secondary uint32
+	if err := db.QueryRow(statements["GetLastLedger"]).Scan(&primary); err != nil {
+		return false
+	}
+	if err := r.QueryRow(statements["GetLastLedger"]).Scan(&secondary); err != nil {
+		r.errors++
+		r.err = err
+		return false
+	}
+	r.caughtUp = secondary+db.replicaLag >= primary
+	return r.caughtUp
+}
+
+// replicaStats reports the replicas that have failed a lag check
+func (db *sqldb) replicaStats() string {
+	var stats []string
+	for i, r := range db.replicas {
+		r.mu.Lock()
+		if r.errors > 0 {
+			stats = append(stats, fmt.Sprintf("Replica %d: %d errors, last: %s", i, r.errors, r.err))
+		}
+		r.mu.Unlock()
+	}
+	return strings.Join(stats, "\n")
+}
+
+func (db *sqldb) Close() error {
+	for _, replica := range db.replicas {
+		replica.Close()
+	}
+	return db.DB.Close()
+}
@@ -0,0 +1,195 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	rippleEpoch      = 946684800
+	pruneChunkLedger = 1000
+)
+
+// RetentionPolicy describes which ledgers are kept. A ledger is pruned
+// when it falls outside either limit. Zero values disable a limit.
+type RetentionPolicy struct {
+	Ledgers  uint32
+	MaxAge   time.Duration
+	Interval time.Duration
+	// Database into which pruned rows are copied before deletion
+	Archive string
+}
+
+// Pruner applies a RetentionPolicy in the background. Lookup tables
+// are never pruned.
+type Pruner struct {
+	policy RetentionPolicy
+	db     *sqldb
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+	mu     sync.Mutex
+	err    error
+}
+
+func NewPruner(db IndexedDB, policy RetentionPolicy) (*Pruner, error) {
+	inner, ok := db.(*sqldb)
+	if !ok {
+		return nil, fmt.Errorf("Cannot prune %T", db)
+	}
+	if policy.Ledgers == 0 && policy.MaxAge == 0 {
+		return nil, fmt.Errorf("Retention policy has no limits")
+	}
+	if policy.Interval == 0 {
+		policy.Interval = time.Hour
+	}
+	return &Pruner{
+		policy: policy,
+		db:     inner,
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+func (p *Pruner) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.policy.Interval)
+		defer ticker.Stop()
+		for {
+			err := p.Prune()
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+			select {
+			case <-ticker.C:
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for a running prune to finish and returns the error from
+// the last one. It may be called more than once.
+func (p *Pruner) Stop() error {
+	p.once.Do(func() { close(p.stop) })
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Horizon returns the first ledger the policy keeps
+func (p *Pruner) Horizon() (uint32, error) {
+	var min, max, horizon uint32
+	if err := p.db.QueryRow(statements["GetLedgerBounds"]).Scan(&min, &max); err != nil {
+		return 0, err
+	}
+	if p.policy.Ledgers > 0 && max >= p.policy.Ledgers {
+		horizon = max - p.policy.Ledgers + 1
+	}
+	if p.policy.MaxAge > 0 {
+		closeTime := time.Now().Add(-p.policy.MaxAge).Unix() - rippleEpoch
+		var first uint32
+		if err := p.db.QueryRow(statements["GetFirstLedgerAfter"], closeTime).Scan(&first); err != nil {
+			return 0, err
+		}
+		// Every stored ledger is too old
+		if first == 0 {
+			first = max + 1
+		}
+		if first > horizon {
+			horizon = first
+		}
+	}
+	return horizon, nil
+}
+
+// Prune removes, and optionally archives, every ledger before the
+// horizon. PrunedBefore is moved before any row is deleted, so neither
+// readers nor an interrupted prune see the ledgers being removed as
+// missing. The next Prune removes any rows an interrupted one left.
+func (p *Pruner) Prune() error {
+	horizon, err := p.Horizon()
+	if err != nil {
+		return err
+	}
+	prunedBefore, err := p.db.PrunedBefore()
+	if err != nil {
+		return err
+	}
+	if horizon > prunedBefore {
+		var min uint32
+		if err := p.db.QueryRow(statements["GetLedgerBounds"]).Scan(&min, new(uint32)); err != nil {
+			return err
+		}
+		if min < prunedBefore {
+			min = prunedBefore
+		}
+		if min < horizon {
+			if err := p.archive(min, horizon-1); err != nil {
+				return err
+			}
+		}
+		if _, err := p.db.Exec(statements["UpdatePrunedBefore"], horizon); err != nil {
+			return err
+		}
+		prunedBefore = horizon
+	}
+	if prunedBefore == 0 {
+		return nil
+	}
+	for _, table := range ledgerTables {
+		if err := p.db.deleteLedgerRange(table, 0, prunedBefore-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archive copies the ledgers from min to max into the archive database
+func (p *Pruner) archive(min, max uint32) error {
+	if p.policy.Archive == "" {
+		return nil
+	}
+	for _, table := range ledgerTables {
+		if _, err := p.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s LIKE %s;", p.policy.Archive, table, table)); err != nil {
+			return err
+		}
+	}
+	for start := min; start <= max; start += pruneChunkLedger {
+		end := start + pruneChunkLedger - 1
+		if end > max || end < start {
+			end = max
+		}
+		for _, table := range ledgerTables {
+			stmnt := fmt.Sprintf("INSERT IGNORE INTO %s.%s SELECT * FROM %s WHERE LedgerSequence BETWEEN ? AND ?;", p.policy.Archive, table, table)
+			if _, err := p.db.Exec(stmnt, start, end); err != nil {
+				return err
+			}
+		}
+		if end == max {
+			break
+		}
+	}
+	return nil
+}
+
+// PrunedBefore returns the first ledger not removed by retention
+func (db *sqldb) PrunedBefore() (uint32, error) {
+	return db.PrunedBeforeContext(context.Background())
+}
+
+func (db *sqldb) PrunedBeforeContext(ctx context.Context) (uint32, error) {
+	return readPrunedBefore(ctx, db.DB)
+}
+
+func readPrunedBefore(ctx context.Context, db *sql.DB) (uint32, error) {
+	var prunedBefore uint32
+	err := db.QueryRowContext(ctx, statements["GetPrunedBefore"]).Scan(&prunedBefore)
+	return prunedBefore, err
+}
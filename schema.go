@@ -17,7 +17,7 @@ var (
 )
 
 var queries = map[string]string{
-	"GetLedgerRange":    `SELECT MIN(LedgerSequence),MAX(LedgerSequence) FROM Ledger;`,
+	"GetLedgerRange":    `SELECT GREATEST(MIN(LedgerSequence),COALESCE((SELECT MAX(PrunedBefore) FROM Retention),0)),MAX(LedgerSequence) FROM Ledger;`,
 	"GetRanges":         `SELECT TransactionType,min(LedgerSequence),max(LedgerSequence) FROM(` + kernel + ` ORDER BY LedgerSequence %s,TransactionIndex %s LIMIT ?)t GROUP BY TransactionType`,
 	"GetTransactions":   `SELECT v.* FROM TransactiontView v` + kernelJoin,
 	"GetPayments":       `SELECT v.* FROM PaymentView v` + kernelJoin,
@@ -28,11 +28,82 @@ var queries = map[string]string{
 	"GetTrustSets":      `SELECT v.* FROM TrustSetView v` + kernelJoin,
 	"GetSetFees":        `SELECT v.* FROM SetFeeView v` + kernelJoin,
 	"GetAmendments":     `SELECT v.* FROM AmendmentView v` + kernelJoin,
+	"GetRawTransaction": `SELECT Raw FROM Transaction WHERE LedgerSequence=? AND TransactionIndex=?;`,
+	"GetMemos":          `SELECT MemoType,MemoData FROM Memo WHERE LedgerSequence=? AND TransactionIndex=? ORDER BY Position;`,
+	"GetPaths": `SELECT p.PathSet,a.Account,c.Currency,i.Account FROM Path p
+LEFT OUTER JOIN Account a  ON p.Account=a.Id
+LEFT OUTER JOIN Currency c ON p.Currency=c.Id
+LEFT OUTER JOIN Account i  ON p.Issuer=i.Id
+WHERE p.LedgerSequence=? AND p.TransactionIndex=? ORDER BY p.PathSet,p.Position;`,
+	"GetLedgerEntries": `SELECT Position,LedgerEntryType,LedgerEntryState,LedgerIndex,PreviousTxnID FROM LedgerEntry WHERE LedgerSequence=? AND TransactionIndex=? ORDER BY Position;`,
+	"GetAccountRootEntry": `SELECT COALESCE(r.Previous_Flags,r.Previous_Sequence,r.Previous_Balance,r.Previous_OwnerCount,r.Previous_RegularKey,r.Previous_EmailHash,r.Previous_WalletLocator,r.Previous_WalletSize,r.Previous_MessageKey,r.Previous_Domain,r.Previous_TransferRate) IS NOT NULL,
+  r.Flags,a.Account,r.Sequence,r.Balance,r.OwnerCount,k.RegularKey,r.EmailHash,r.WalletLocator,r.WalletSize,r.MessageKey,r.Domain,r.TransferRate,
+  r.Previous_Flags,r.Previous_Sequence,r.Previous_Balance,r.Previous_OwnerCount,pk.RegularKey,r.Previous_EmailHash,r.Previous_WalletLocator,r.Previous_WalletSize,r.Previous_MessageKey,r.Previous_Domain,r.Previous_TransferRate
+FROM AccountRoot r
+LEFT OUTER JOIN Account a     ON r.Account=a.Id
+LEFT OUTER JOIN RegularKey k  ON r.RegularKey=k.Id
+LEFT OUTER JOIN RegularKey pk ON r.Previous_RegularKey=pk.Id
+WHERE r.LedgerSequence=? AND r.TransactionIndex=? AND r.Position=?;`,
+	"GetOfferEntry": `SELECT COALESCE(o.Previous_Flags,o.Previous_Sequence,o.Previous_TakerPays,o.Previous_TakerGets,o.Previous_Expiration,o.Previous_BookDirectory,o.Previous_BookNode,o.Previous_OwnerNode) IS NOT NULL,
+  o.Flags,a.Account,o.Sequence,o.TakerPays,pc.Currency,pi.Account,o.TakerGets,gc.Currency,gi.Account,o.Expiration,o.BookDirectory,o.BookNode,o.OwnerNode,
+  o.Previous_Flags,o.Previous_Sequence,o.Previous_TakerPays,ppc.Currency,ppi.Account,o.Previous_TakerGets,pgc.Currency,pgi.Account,o.Previous_Expiration,o.Previous_BookDirectory,o.Previous_BookNode,o.Previous_OwnerNode
+FROM Offer o
+LEFT OUTER JOIN Account a    ON o.Account=a.Id
+LEFT OUTER JOIN Currency pc  ON o.TakerPaysCurrency=pc.Id
+LEFT OUTER JOIN Account pi   ON o.TakerPaysIssuer=pi.Id
+LEFT OUTER JOIN Currency gc  ON o.TakerGetsCurrency=gc.Id
+LEFT OUTER JOIN Account gi   ON o.TakerGetsIssuer=gi.Id
+LEFT OUTER JOIN Currency ppc ON o.Previous_TakerPaysCurrency=ppc.Id
+LEFT OUTER JOIN Account ppi  ON o.Previous_TakerPaysIssuer=ppi.Id
+LEFT OUTER JOIN Currency pgc ON o.Previous_TakerGetsCurrency=pgc.Id
+LEFT OUTER JOIN Account pgi  ON o.Previous_TakerGetsIssuer=pgi.Id
+WHERE o.LedgerSequence=? AND o.TransactionIndex=? AND o.Position=?;`,
+	"GetRippleStateEntry": `SELECT COALESCE(r.Previous_Flags,r.Previous_Balance,r.Previous_LowLimit,r.Previous_HighLimit,r.Previous_LowNode,r.Previous_HighNode,r.Previous_LowQualityIn,r.Previous_LowQualityOut,r.Previous_HighQualityIn,r.Previous_HighQualityOut) IS NOT NULL,
+  r.Flags,r.Balance,c.Currency,r.LowLimit,l.Account,r.HighLimit,h.Account,r.LowNode,r.HighNode,r.LowQualityIn,r.LowQualityOut,r.HighQualityIn,r.HighQualityOut,
+  r.Previous_Flags,r.Previous_Balance,pc.Currency,r.Previous_LowLimit,pl.Account,r.Previous_HighLimit,ph.Account,r.Previous_LowNode,r.Previous_HighNode,r.Previous_LowQualityIn,r.Previous_LowQualityOut,r.Previous_HighQualityIn,r.Previous_HighQualityOut
+FROM RippleState r
+LEFT OUTER JOIN Currency c  ON r.Currency=c.Id
+LEFT OUTER JOIN Account l   ON r.LowLimitIssuer=l.Id
+LEFT OUTER JOIN Account h   ON r.HighLimitIssuer=h.Id
+LEFT OUTER JOIN Currency pc ON r.Previous_Currency=pc.Id
+LEFT OUTER JOIN Account pl  ON r.Previous_LowLimitIssuer=pl.Id
+LEFT OUTER JOIN Account ph  ON r.Previous_HighLimitIssuer=ph.Id
+WHERE r.LedgerSequence=? AND r.TransactionIndex=? AND r.Position=?;`,
+	"GetDirectoryEntry": `SELECT COALESCE(d.Previous_RootIndex,d.Previous_Owner,d.Previous_TakerPaysCurrency,d.Previous_TakerPaysIssuer,d.Previous_TakerGetsCurrency,d.Previous_TakerGetsIssuer,d.Previous_IndexNext,d.Previous_IndexPrevious) IS NOT NULL,
+  d.RootIndex,o.Account,pc.Currency,pi.Account,gc.Currency,gi.Account,d.IndexNext,d.IndexPrevious,
+  d.Previous_RootIndex,po.Account,ppc.Currency,ppi.Account,pgc.Currency,pgi.Account,d.Previous_IndexNext,d.Previous_IndexPrevious
+FROM Directory d
+LEFT OUTER JOIN Account o    ON d.Owner=o.Id
+LEFT OUTER JOIN Currency pc  ON d.TakerPaysCurrency=pc.Id
+LEFT OUTER JOIN Account pi   ON d.TakerPaysIssuer=pi.Id
+LEFT OUTER JOIN Currency gc  ON d.TakerGetsCurrency=gc.Id
+LEFT OUTER JOIN Account gi   ON d.TakerGetsIssuer=gi.Id
+LEFT OUTER JOIN Account po   ON d.Previous_Owner=po.Id
+LEFT OUTER JOIN Currency ppc ON d.Previous_TakerPaysCurrency=ppc.Id
+LEFT OUTER JOIN Account ppi  ON d.Previous_TakerPaysIssuer=ppi.Id
+LEFT OUTER JOIN Currency pgc ON d.Previous_TakerGetsCurrency=pgc.Id
+LEFT OUTER JOIN Account pgi  ON d.Previous_TakerGetsIssuer=pgi.Id
+WHERE d.LedgerSequence=? AND d.TransactionIndex=? AND d.Position=?;`,
+	"GetFeeSettingsEntry": `SELECT COALESCE(Previous_BaseFee,Previous_ReferenceFeeUnits,Previous_ReserveBase,Previous_ReserveIncrement) IS NOT NULL,
+  Flags,BaseFee,ReferenceFeeUnits,ReserveBase,ReserveIncrement,
+  Previous_BaseFee,Previous_ReferenceFeeUnits,Previous_ReserveBase,Previous_ReserveIncrement
+FROM FeeSettings WHERE LedgerSequence=? AND TransactionIndex=? AND Position=?;`,
+	"GetAmendmentsEntry": `SELECT COALESCE(Previous_Flags,Previous_Amendments) IS NOT NULL,
+  Flags,Amendments,Previous_Flags,Previous_Amendments
+FROM Amendments WHERE LedgerSequence=? AND TransactionIndex=? AND Position=?;`,
+	"GetLedgerHashesEntry": `SELECT COALESCE(Previous_Flags,Previous_FirstLedgerSequence,Previous_LastLedgerSequence,Previous_Hashes) IS NOT NULL,
+  Flags,FirstLedgerSequence,LastLedgerSequence,Hashes,Previous_Flags,Previous_FirstLedgerSequence,Previous_LastLedgerSequence,Previous_Hashes
+FROM LedgerHashes WHERE LedgerSequence=? AND TransactionIndex=? AND Position=?;`,
 }
 
 var statements = map[string]string{
-	"InsertLedger":        `REPLACE INTO Ledger VALUES(?,?,?,?,?,?,?,?,?,?);`,
-	"InsertTransaction":   `REPLACE INTO Transaction VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?);`,
+	"InsertLedger":        `INSERT INTO Ledger VALUES(?,?,?,?,?,?,?,?,?,?,?,?) ON DUPLICATE KEY UPDATE Complete=Complete AND Hash=VALUES(Hash),TotalXRP=VALUES(TotalXRP),PreviousLedger=VALUES(PreviousLedger),TransactionHash=VALUES(TransactionHash),StateHash=VALUES(StateHash),ParentCloseTime=VALUES(ParentCloseTime),CloseTime=VALUES(CloseTime),CloseResolution=VALUES(CloseResolution),CloseFlags=VALUES(CloseFlags),Hash=VALUES(Hash),Raw=VALUES(Raw);`,
+	"CompleteLedger":      `UPDATE Ledger SET Complete=TRUE WHERE LedgerSequence=? AND Hash=?;`,
+	"IsLedgerComplete":    `SELECT Complete FROM Ledger WHERE LedgerSequence=? AND Hash=?;`,
+	"CountTransactions":   `SELECT COUNT(*) FROM Transaction WHERE LedgerSequence=?;`,
+	"GetLedgerRaw":        `SELECT LedgerSequence,Raw FROM Ledger WHERE Hash=?;`,
+	"GetTransactionRaw":   `SELECT LedgerSequence,Raw FROM Transaction WHERE Hash=?;`,
+	"InsertTransaction":   `REPLACE INTO Transaction VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?);`,
 	"InsertPayment":       `REPLACE INTO Payment VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?);`,
 	"InsertOfferCreate":   `REPLACE INTO OfferCreate VALUES(?,?,?,?,?,?,?,?,?,?);`,
 	"InsertOfferCancel":   `REPLACE INTO OfferCancel VALUES(?,?,?);`,
@@ -49,17 +120,68 @@ var statements = map[string]string{
 	"InsertOffer":         `REPLACE INTO Offer VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`,
 	"InsertFeeSettings":   `REPLACE INTO FeeSettings VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?);`,
 	"InsertDirectory":     `REPLACE INTO Directory VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`,
+	"InsertAmendments":    `REPLACE INTO Amendments VALUES(?,?,?,?,?,?,?);`,
+	"InsertLedgerHashes":  `REPLACE INTO LedgerHashes VALUES(?,?,?,?,?,?,?,?,?,?,?);`,
 
-	"GetAccounts":      `SELECT Id,Account,Human FROM Account;`,
-	"InsertAccount":    `REPLACE INTO Account VALUES(?,?,?);`,
-	"GetRegularKeys":   `SELECT Id,RegularKey,Human FROM RegularKey;`,
-	"InsertRegularKey": `REPLACE INTO RegularKey VALUES(?,?,?);`,
-	"GetPublicKeys":    `SELECT Id,PublicKey,Human FROM PublicKey;`,
-	"InsertPublicKey":  `REPLACE INTO PublicKey VALUES(?,?,?);`,
-	"GetCurrencies":    `SELECT Id,Currency,Human FROM Currency;`,
-	"InsertCurrency":   `REPLACE INTO Currency VALUES(?,?,?);`,
+	"InsertConflict":          `INSERT INTO Conflict(TableName,LedgerSequence,TransactionIndex,Columns,Detected) VALUES(?,?,?,?,NOW());`,
+	"GetLedgerHash":           `SELECT Hash FROM Ledger WHERE LedgerSequence=? FOR UPDATE;`,
+	"InsertOrphanLedger":      `INSERT IGNORE INTO OrphanLedger SELECT ` + ledgerColumns + `,NOW(),Raw FROM Ledger WHERE LedgerSequence=?;`,
+	"InsertOrphanTransaction": `INSERT IGNORE INTO OrphanTransaction SELECT ?,LedgerSequence,TransactionIndex,TransactionResult,TransactionType,Account,Hash,Raw FROM Transaction WHERE LedgerSequence=?;`,
+	"IsForkedTransaction":     `SELECT l.Complete AND t.Hash IS NULL FROM Ledger l LEFT OUTER JOIN Transaction t ON t.LedgerSequence=l.LedgerSequence AND t.Hash=? WHERE l.LedgerSequence=?;`,
+	"InsertLedgerConflict":    `REPLACE INTO LedgerConflict VALUES(?,?,?,NOW());`,
+	"GetLedgerConflicts":      `SELECT LedgerSequence,Hash,OrphanHash,UNIX_TIMESTAMP(Detected) FROM LedgerConflict WHERE LedgerSequence BETWEEN ? AND ? ORDER BY LedgerSequence;`,
+	"GetPrunedBefore":         `SELECT COALESCE(MAX(PrunedBefore),0) FROM Retention;`,
+	"UpdatePrunedBefore":      `REPLACE INTO Retention VALUES(1,?,NOW());`,
+	"GetLastLedger":           `SELECT COALESCE(MAX(LedgerSequence),0) FROM Ledger;`,
+	"GetLedgerBounds":         `SELECT COALESCE(MIN(LedgerSequence),0),COALESCE(MAX(LedgerSequence),0) FROM Ledger;`,
+	"GetFirstLedgerAfter":     `SELECT COALESCE(MIN(LedgerSequence),0) FROM Ledger WHERE CloseTime>=?;`,
+	"GetSchemaVersion":        `SELECT COALESCE(MAX(Version),0) FROM SchemaVersion;`,
+	"InsertSchemaVersion":     `INSERT INTO SchemaVersion VALUES(?,?,NOW());`,
+	"GetCheckpoint":           `SELECT LedgerSequence FROM Checkpoint WHERE Name=?;`,
+	"UpdateCheckpoint":        `REPLACE INTO Checkpoint VALUES(?,?,NOW());`,
+	"GetArchiveIdentity":      `SELECT CONCAT(@@server_uuid,'/',DATABASE(),'/',COALESCE((SELECT MIN(Created) FROM RippleMarker),''));`,
+
+	"GetAccounts":         `SELECT Id,Account,Human FROM Account;`,
+	"GetAccount":          `SELECT Account,Human FROM Account WHERE Id=?;`,
+	"GetAccountsAfter":    `SELECT Id,Account,Human FROM Account WHERE Id>?;`,
+	"GetAccountsById":     `SELECT Id,Account,Human FROM Account WHERE Id IN (%s);`,
+	"GetAccountId":        `SELECT Id FROM Account WHERE Account=?;`,
+	"LockAccountId":       `SELECT Id FROM Account WHERE Account=? LOCK IN SHARE MODE;`,
+	"InsertAccount":       `INSERT INTO Account SELECT COALESCE(MAX(Id)+1,0),?,? FROM Account;`,
+	"GetRegularKeys":      `SELECT Id,RegularKey,Human FROM RegularKey;`,
+	"GetRegularKey":       `SELECT RegularKey,Human FROM RegularKey WHERE Id=?;`,
+	"GetRegularKeysAfter": `SELECT Id,RegularKey,Human FROM RegularKey WHERE Id>?;`,
+	"GetRegularKeysById":  `SELECT Id,RegularKey,Human FROM RegularKey WHERE Id IN (%s);`,
+	"GetRegularKeyId":     `SELECT Id FROM RegularKey WHERE RegularKey=?;`,
+	"LockRegularKeyId":    `SELECT Id FROM RegularKey WHERE RegularKey=? LOCK IN SHARE MODE;`,
+	"InsertRegularKey":    `INSERT INTO RegularKey SELECT COALESCE(MAX(Id)+1,0),?,? FROM RegularKey;`,
+	"GetPublicKeys":       `SELECT Id,PublicKey,Human FROM PublicKey;`,
+	"GetPublicKey":        `SELECT PublicKey,Human FROM PublicKey WHERE Id=?;`,
+	"GetPublicKeysAfter":  `SELECT Id,PublicKey,Human FROM PublicKey WHERE Id>?;`,
+	"GetPublicKeysById":   `SELECT Id,PublicKey,Human FROM PublicKey WHERE Id IN (%s);`,
+	"GetPublicKeyId":      `SELECT Id FROM PublicKey WHERE PublicKey=?;`,
+	"LockPublicKeyId":     `SELECT Id FROM PublicKey WHERE PublicKey=? LOCK IN SHARE MODE;`,
+	"InsertPublicKey":     `INSERT INTO PublicKey SELECT COALESCE(MAX(Id)+1,0),?,? FROM PublicKey;`,
+	"GetCurrencies":       `SELECT Id,Currency,Human FROM Currency;`,
+	"GetCurrency":         `SELECT Currency,Human FROM Currency WHERE Id=?;`,
+	"GetCurrenciesAfter":  `SELECT Id,Currency,Human FROM Currency WHERE Id>?;`,
+	"GetCurrenciesById":   `SELECT Id,Currency,Human FROM Currency WHERE Id IN (%s);`,
+	"GetCurrencyId":       `SELECT Id FROM Currency WHERE Currency=?;`,
+	"LockCurrencyId":      `SELECT Id FROM Currency WHERE Currency=? LOCK IN SHARE MODE;`,
+	"InsertCurrency":      `INSERT INTO Currency SELECT COALESCE(MAX(Id)+1,0),?,? FROM Currency;`,
+}
+
+// ledgerTables are all the tables keyed by LedgerSequence. The tables
+// of each TransactionHandler and LedgerEntryHandler are added when it
+// is registered.
+var ledgerTables = []string{
+	"Ledger",
+	"Transaction",
+	"Memo",
+	"LedgerEntry",
 }
 
+// schema is the first migration. Later changes belong in migrations.
 var schema = []string{`
 CREATE TABLE IF NOT EXISTS Currency(
   Id INT UNSIGNED NOT NULL,
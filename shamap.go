@@ -0,0 +1,56 @@
+package mysql
+
+import (
+	"crypto/sha512"
+	"github.com/rubblelabs/ripple/data"
+)
+
+var innerNodePrefix = []byte("MIN\x00")
+
+type shaMapLeaf struct {
+	key, hash data.Hash256
+}
+
+// transactionTreeHash computes the root of the transaction SHAMap that
+// a ledger's TransactionHash commits to.
+func transactionTreeHash(txs []*data.TransactionWithMetaData) (data.Hash256, error) {
+	leaves := make([]shaMapLeaf, len(txs))
+	for i, txm := range txs {
+		hash, err := data.NodeId(txm)
+		if err != nil {
+			return data.Hash256{}, err
+		}
+		leaves[i] = shaMapLeaf{key: *txm.GetHash(), hash: hash}
+	}
+	if len(leaves) == 0 {
+		return data.Hash256{}, nil
+	}
+	return shaMapInner(leaves, 0), nil
+}
+
+func shaMapInner(leaves []shaMapLeaf, depth int) data.Hash256 {
+	var branches [16][]shaMapLeaf
+	for _, leaf := range leaves {
+		nibble := leaf.key[depth/2]
+		if depth%2 == 0 {
+			nibble >>= 4
+		}
+		branches[nibble&0x0F] = append(branches[nibble&0x0F], leaf)
+	}
+	hasher := sha512.New()
+	hasher.Write(innerNodePrefix)
+	for _, branch := range branches {
+		var hash data.Hash256
+		switch len(branch) {
+		case 0:
+		case 1:
+			hash = branch[0].hash
+		default:
+			hash = shaMapInner(branch, depth+1)
+		}
+		hasher.Write(hash[:])
+	}
+	var root data.Hash256
+	copy(root[:], hasher.Sum(nil))
+	return root
+}
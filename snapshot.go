@@ -0,0 +1,208 @@
+package mysql
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotVersion = 2
+	// widest value of a lookup table, a public key
+	maxSnapshotWidth = 64
+)
+
+var (
+	snapshotMagic       = [4]byte{'R', 'L', 'K', 'S'}
+	errSnapshotMismatch = errors.New("Lookup snapshot does not match the archive")
+)
+
+// snapshotTable holds the rows of a lookup table up to Max
+type snapshotTable struct {
+	Max    uint32
+	Ids    []uint32
+	Values [][]byte
+}
+
+// WriteLookupSnapshot writes every row of the lookup tables to path.
+// Opening a database with Options.LookupSnapshot set to path then only
+// reads the rows added since. The file is replaced atomically.
+func (db *sqldb) WriteLookupSnapshot(path string) error {
+	identity, err := db.identity()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	tables := []lookupStatements{
+		db.accounts.stmnts,
+		db.regularKeys.stmnts,
+		db.publicKeys.stmnts,
+		db.currencies.stmnts,
+	}
+	header := []interface{}{snapshotMagic, uint32(snapshotVersion), uint16(len(identity)), []byte(identity), uint32(len(tables))}
+	if err := writeSnapshot(w, header...); err != nil {
+		f.Close()
+		return err
+	}
+	for _, stmnts := range tables {
+		if err := db.writeSnapshotTable(w, stmnts); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (db *sqldb) writeSnapshotTable(w io.Writer, stmnts lookupStatements) error {
+	items, err := db.GetLookups(stmnts.All)
+	if err != nil {
+		return err
+	}
+	var max, width uint32
+	for _, item := range items {
+		if item.Id > max {
+			max = item.Id
+		}
+		width = uint32(len(item.Value.([]byte)))
+	}
+	if err := writeSnapshot(w, uint16(len(stmnts.Table)), []byte(stmnts.Table), width, max, uint32(len(items))); err != nil {
+		return err
+	}
+	for _, item := range items {
+		value := item.Value.([]byte)
+		if uint32(len(value)) != width {
+			return fmt.Errorf("Mixed value sizes in %s", stmnts.Table)
+		}
+		if err := writeSnapshot(w, item.Id, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// identity names the archive a snapshot is written from: the server,
+// the database, when the archive was created and its table prefix.
+func (db *sqldb) identity() (string, error) {
+	var identity string
+	if err := db.QueryRow(statements["GetArchiveIdentity"]).Scan(&identity); err != nil {
+		return "", err
+	}
+	return identity + "/" + db.prefix, nil
+}
+
+func writeSnapshot(w io.Writer, values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLookupSnapshot reads the snapshot at path by table name. A
+// missing or corrupt file, or one written from an archive other than
+// identity, is an empty snapshot so that the lookups are read in full.
+func readLookupSnapshot(path, identity string) (map[string]*snapshotTable, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := decodeSnapshot(bufio.NewReader(f), info.Size(), identity)
+	if err != nil {
+		return nil, nil
+	}
+	return snapshot, nil
+}
+
+// decodeSnapshot reads a snapshot of size bytes from r, failing when it
+// is corrupt or was not written from identity.
+func decodeSnapshot(r io.Reader, size int64, identity string) (map[string]*snapshotTable, error) {
+	var (
+		magic          [4]byte
+		version, count uint32
+		identityLength uint16
+		snapshot       = make(map[string]*snapshotTable)
+	)
+	if err := readSnapshot(r, &magic, &version); err != nil {
+		return nil, err
+	}
+	if magic != snapshotMagic || version != snapshotVersion {
+		return nil, errSnapshotMismatch
+	}
+	if err := readSnapshot(r, &identityLength); err != nil {
+		return nil, err
+	}
+	written := make([]byte, identityLength)
+	if err := readSnapshot(r, written, &count); err != nil {
+		return nil, err
+	}
+	if string(written) != identity {
+		return nil, errSnapshotMismatch
+	}
+	for ; count > 0; count-- {
+		var (
+			nameLength        uint16
+			width, max, items uint32
+		)
+		if err := readSnapshot(r, &nameLength); err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLength)
+		if err := readSnapshot(r, name, &width, &max, &items); err != nil {
+			return nil, err
+		}
+		if width > maxSnapshotWidth || int64(items)*int64(width+4) > size {
+			return nil, errSnapshotMismatch
+		}
+		table := &snapshotTable{
+			Max:    max,
+			Ids:    make([]uint32, items),
+			Values: make([][]byte, items),
+		}
+		values := make([]byte, int(width)*int(items))
+		for i := range table.Ids {
+			table.Values[i] = values[i*int(width) : (i+1)*int(width)]
+			if err := readSnapshot(r, &table.Ids[i], table.Values[i]); err != nil {
+				return nil, err
+			}
+		}
+		snapshot[string(name)] = table
+	}
+	return snapshot, nil
+}
+
+func readSnapshot(r io.Reader, values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
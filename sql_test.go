@@ -1,11 +1,21 @@
 package mysql
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"flag"
+	"fmt"
 	"github.com/rubblelabs/ripple/data"
+	"github.com/rubblelabs/ripple/storage"
 	internal "github.com/rubblelabs/ripple/testing"
+	"io"
 	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 )
 
 var connectionstring = flag.String("connection_string", "ripple:ripple123@/rippletest", "connection string to run tests against")
@@ -20,28 +30,73 @@ type SqlSuite struct{}
 
 var _ = Suite(&SqlSuite{})
 
-func (s *SqlSuite) TestMySql(c *C) {
-	db, err := NewMySqlDB(*connectionstring, true)
-	c.Assert(err, IsNil)
-	var hashes []data.Hash256
+// readNodes decodes the ledgers and transactions in internal.Nodes
+func readNodes(c *C) []data.Storer {
+	nodes, _ := readEncodedNodes(c)
+	return nodes
+}
+
+// readEncodedNodes is readNodes that also returns the encoding of each
+// node by hash, without the node store header that Raw columns omit
+func readEncodedNodes(c *C) ([]data.Storer, map[data.Hash256][]byte) {
+	var (
+		nodes     []data.Storer
+		encodings = make(map[data.Hash256][]byte)
+	)
 	for _, test := range internal.Nodes {
 		nodeId, err := data.NewHash256(test.NodeId())
 		c.Assert(err, IsNil)
-		node, err := data.ReadPrefix(test.Reader(), *nodeId)
+		b, err := io.ReadAll(test.Reader())
 		c.Assert(err, IsNil)
+		node, err := data.ReadPrefix(bytes.NewReader(b), *nodeId)
+		c.Assert(err, IsNil, Commentf(test.Description))
 		c.Assert(node, NotNil)
 		switch node.(type) {
 		case *data.TransactionWithMetaData, *data.Ledger:
-			hashes = append(hashes, *node.GetHash())
-			c.Assert(db.Insert(node), IsNil, Commentf(test.Description))
+			nodes = append(nodes, node)
+			encodings[*node.GetHash()] = b[rawHeaderSize:]
+		}
+	}
+	return nodes, encodings
+}
+
+// insertNodes inserts readNodes into db one at a time
+func insertNodes(c *C, db IndexedDB) []data.Storer {
+	nodes := readNodes(c)
+	for _, node := range nodes {
+		c.Assert(db.Insert(node), IsNil, Commentf(node.GetHash().String()))
+	}
+	return nodes
+}
+
+// byLedger splits nodes into ledgers and transactions by sequence
+func byLedger(nodes []data.Storer) ([]*data.Ledger, map[uint32][]*data.TransactionWithMetaData) {
+	var (
+		ledgers []*data.Ledger
+		txs     = make(map[uint32][]*data.TransactionWithMetaData)
+	)
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case *data.Ledger:
+			ledgers = append(ledgers, v)
+		case *data.TransactionWithMetaData:
+			txs[v.LedgerSequence] = append(txs[v.LedgerSequence], v)
 		}
 	}
+	return ledgers, txs
+}
+
+func (s *SqlSuite) TestMySql(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := insertNodes(c, db)
 	items, err := db.GetLookups("GetAccounts")
 	c.Assert(err, IsNil)
 	c.Assert(len(items), Equals, 47)
 	c.Assert(db.GetAccount(0), NotNil)
 	c.Assert(db.GetAccount(100), IsNil)
-	for _, hash := range hashes {
+	for _, expected := range nodes {
+		hash := *expected.GetHash()
 		node, err := db.Get(hash)
 		c.Assert(err, IsNil, Commentf(hash.String()))
 		c.Assert(node, NotNil)
@@ -52,3 +107,995 @@ func (s *SqlSuite) TestMySql(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(len(accounts), Not(Equals), 0)
 }
+
+func (s *SqlSuite) TestInsertBatch(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := readNodes(c)
+	c.Assert(db.InsertBatch(nodes), IsNil)
+	for _, expected := range nodes {
+		hash := *expected.GetHash()
+		node, err := db.Get(hash)
+		c.Assert(err, IsNil, Commentf(hash.String()))
+		c.Assert(node.GetHash().String(), Equals, hash.String())
+	}
+}
+
+func (s *SqlSuite) TestMultiRow(c *C) {
+	for query, expected := range map[string]string{
+		"REPLACE INTO Memo VALUES(?,?);":                                   "REPLACE INTO Memo VALUES(?,?),(?,?);",
+		"REPLACE INTO Ledger VALUES(?,NOW())":                              "REPLACE INTO Ledger VALUES(?,NOW()),(?,NOW())",
+		"INSERT INTO Memo VALUES(?,?) ON DUPLICATE KEY UPDATE Position=1;": "INSERT INTO Memo VALUES(?,?),(?,?) ON DUPLICATE KEY UPDATE Position=1;",
+	} {
+		stmnt, err := multiRow(query, 2)
+		c.Assert(err, IsNil)
+		c.Assert(stmnt, Equals, expected)
+	}
+	_, err := multiRow("UPDATE Ledger SET Complete=TRUE;", 2)
+	c.Assert(err, NotNil)
+	result, err := newBatch().Exec(statements["InsertMemo"], 1, 2, 3, nil, nil)
+	c.Assert(err, IsNil)
+	n, err := result.RowsAffected()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(0))
+}
+
+func (s *SqlSuite) TestDeleteLedgers(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := insertNodes(c, db)
+	c.Assert(db.TruncateAfter(0), IsNil)
+	for _, node := range nodes {
+		hash := *node.GetHash()
+		_, err := db.Get(hash)
+		c.Assert(err, Equals, storage.ErrNotFound, Commentf(hash.String()))
+	}
+}
+
+func (s *SqlSuite) TestDeleteLedgerRange(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := insertNodes(c, db)
+	var seqs []uint32
+	for _, node := range nodes {
+		seqs = append(seqs, ledgerSequence(node))
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	c.Assert(len(seqs) > 2, Equals, true)
+	start, end := seqs[1], seqs[len(seqs)-2]
+	if start == seqs[0] {
+		start++
+	}
+	if end == seqs[len(seqs)-1] {
+		end--
+	}
+	c.Assert(start <= end, Equals, true, Commentf("No ledgers between %d and %d", seqs[0], seqs[len(seqs)-1]))
+	count := func(table string) (n int) {
+		stmnt := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE LedgerSequence BETWEEN ? AND ?;", table)
+		c.Assert(db.(*sqldb).QueryRow(stmnt, start, end).Scan(&n), IsNil, Commentf(table))
+		return n
+	}
+	var before int
+	for _, table := range ledgerTables[2:] {
+		before += count(table)
+	}
+	c.Assert(before, Not(Equals), 0, Commentf("No dependent rows between %d and %d", start, end))
+	c.Assert(db.DeleteLedgers(start, end), IsNil)
+	for _, table := range ledgerTables {
+		c.Assert(count(table), Equals, 0, Commentf(table))
+	}
+	for _, node := range nodes {
+		hash := *node.GetHash()
+		_, err := db.Get(hash)
+		if seq := ledgerSequence(node); seq >= start && seq <= end {
+			c.Assert(err, Equals, storage.ErrNotFound, Commentf(hash.String()))
+		} else {
+			c.Assert(err, IsNil, Commentf(hash.String()))
+		}
+	}
+}
+
+func (s *SqlSuite) TestReverseLookups(c *C) {
+	db, err := NewMySqlDBWithOptions(Options{
+		DSN:             *connectionstring,
+		Reset:           true,
+		LookupCache:     LookupCacheBounded,
+		LookupCacheSize: 10,
+	})
+	c.Assert(err, IsNil)
+	insertNodes(c, db)
+	items, err := db.GetLookups("GetAccounts")
+	c.Assert(err, IsNil)
+	ids := []uint32{100000}
+	for _, item := range items {
+		ids = append(ids, item.Id)
+	}
+	accounts, err := db.GetAccounts(ids)
+	c.Assert(err, IsNil)
+	c.Assert(len(accounts), Equals, len(ids))
+	c.Assert(accounts[0], IsNil)
+	for i, account := range accounts[1:] {
+		c.Assert(account, NotNil)
+		c.Assert(account.String(), Equals, items[i].Human)
+		c.Assert(db.GetAccount(ids[i+1]).String(), Equals, items[i].Human)
+	}
+	c.Assert(db.GetCurrency(0), NotNil)
+	c.Assert(db.GetCurrency(100000), IsNil)
+}
+
+func (s *SqlSuite) TestFindDoesNotInsert(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	before, err := db.GetLookups("GetAccounts")
+	c.Assert(err, IsNil)
+	address := "rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh"
+	account, err := data.NewAccountFromAddress(address)
+	c.Assert(err, IsNil)
+	_, err = db.FindAccount(account)
+	c.Assert(err, Equals, storage.ErrNotFound)
+	_, err = NewTransactionQuery(db, map[string]string{"Account": address})
+	c.Assert(err, NotNil)
+	accounts, err := db.SearchAccounts(address)
+	c.Assert(err, IsNil)
+	c.Assert(accounts, HasLen, 0)
+	after, err := db.GetLookups("GetAccounts")
+	c.Assert(err, IsNil)
+	c.Assert(len(after), Equals, len(before))
+}
+
+func (s *SqlSuite) TestLookupSnapshot(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	insertNodes(c, db)
+	path := filepath.Join(c.MkDir(), "lookups")
+	c.Assert(db.WriteLookupSnapshot(path), IsNil)
+	items, err := db.GetLookups("GetAccounts")
+	c.Assert(err, IsNil)
+	c.Assert(len(items) > 1, Equals, true)
+	// Rows read from the snapshot keep the value they had when it was
+	// written, so a changed row shows that the snapshot was used
+	var changed, added data.Account
+	changed[0], added[0] = 0xfe, 0xff
+	_, err = db.(*sqldb).Exec(`UPDATE Account SET Account=? WHERE Id=0;`, changed[:])
+	c.Assert(err, IsNil)
+	addedId, err := db.(*sqldb).accounts.Lookup(&added)
+	c.Assert(err, IsNil)
+	restarted, err := NewMySqlDBWithOptions(Options{DSN: *connectionstring, LookupSnapshot: path})
+	c.Assert(err, IsNil)
+	for _, item := range items {
+		account := restarted.GetAccount(item.Id)
+		c.Assert(account, NotNil)
+		c.Assert(account.String(), Equals, item.Human)
+	}
+	c.Assert(restarted.GetAccount(addedId), DeepEquals, &added)
+
+	// A snapshot of the archive before a reset is ignored
+	reset, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	_, err = reset.(*sqldb).accounts.Lookup(&added)
+	c.Assert(err, IsNil)
+	restarted, err = NewMySqlDBWithOptions(Options{DSN: *connectionstring, LookupSnapshot: path})
+	c.Assert(err, IsNil)
+	ids, err := reset.GetLookups("GetAccounts")
+	c.Assert(err, IsNil)
+	c.Assert(ids, HasLen, 2)
+	for _, item := range ids {
+		account := restarted.GetAccount(item.Id)
+		c.Assert(account, NotNil)
+		c.Assert(account.String(), Equals, item.Human)
+	}
+
+	// So is a corrupt one
+	c.Assert(os.WriteFile(path, []byte("RLKS corrupt"), 0644), IsNil)
+	restarted, err = NewMySqlDBWithOptions(Options{DSN: *connectionstring, LookupSnapshot: path})
+	c.Assert(err, IsNil)
+	c.Assert(restarted.GetAccount(1), DeepEquals, &added)
+}
+
+// storedRaw returns the Raw column of the ledger or transaction with hash
+func storedRaw(c *C, db IndexedDB, hash data.Hash256) []byte {
+	for _, table := range rawTables {
+		var raw []byte
+		err := db.(*sqldb).QueryRow(statements[table.stmnt], hash.Bytes()).Scan(new(uint32), &raw)
+		if err == nil {
+			return raw
+		}
+		c.Assert(err, Equals, sql.ErrNoRows)
+	}
+	c.Fatalf("No row for %s", hash)
+	return nil
+}
+
+func (s *SqlSuite) TestGetRaw(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	_, encodings := readEncodedNodes(c)
+	for _, node := range insertNodes(c, db) {
+		hash := *node.GetHash()
+		c.Assert(storedRaw(c, db, hash), DeepEquals, encodings[hash], Commentf(hash.String()))
+		stored, err := db.Get(hash)
+		c.Assert(err, IsNil)
+		raw, err := rawNode(stored)
+		c.Assert(err, IsNil)
+		c.Assert(raw, DeepEquals, encodings[hash], Commentf(hash.String()))
+	}
+}
+
+func (s *SqlSuite) TestUnregisteredTypes(c *C) {
+	nodes, encodings := readEncodedNodes(c)
+	var txm *data.TransactionWithMetaData
+	for _, node := range nodes {
+		if t, ok := node.(*data.TransactionWithMetaData); ok && len(t.MetaData.AffectedNodes) > 0 {
+			txm = t
+			break
+		}
+	}
+	c.Assert(txm, NotNil)
+	typ := txm.GetTransactionType()
+	affected, _, _, _ := txm.MetaData.AffectedNodes[0].AffectedNode()
+	entryType := affected.LedgerEntryType
+
+	// Store the transaction and its first entry as types without handlers
+	txHandler, entryHandler := transactionHandlers[typ], ledgerEntryHandlers[entryType]
+	delete(transactionHandlers, typ)
+	delete(ledgerEntryHandlers, entryType)
+	defer func() {
+		transactionHandlers[typ], ledgerEntryHandlers[entryType] = txHandler, entryHandler
+	}()
+
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	for _, node := range nodes {
+		c.Assert(db.Insert(node), IsNil, Commentf(node.GetHash().String()))
+	}
+	hash := *txm.GetHash()
+	c.Assert(storedRaw(c, db, hash), DeepEquals, encodings[hash])
+	stored, err := db.Get(hash)
+	c.Assert(err, IsNil)
+	raw, err := rawNode(stored)
+	c.Assert(err, IsNil)
+	c.Assert(raw, DeepEquals, encodings[hash])
+
+	query, err := NewTransactionQuery(db, map[string]string{"Hash": hash.String(), "Full": "true"})
+	c.Assert(err, IsNil)
+	var result QueryResult
+	c.Assert(db.Query(query, &result), IsNil)
+	c.Assert(result.Transactions, HasLen, 1)
+	c.Assert(result.Transactions[0].GetTransactionType(), Equals, typ)
+	raw, err = rawNode(result.Transactions[0].TransactionWithMetaData)
+	c.Assert(err, IsNil)
+	c.Assert(raw, DeepEquals, encodings[hash])
+}
+
+func (s *SqlSuite) TestFullTransactionQuery(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	for _, node := range insertNodes(c, db) {
+		txm, ok := node.(*data.TransactionWithMetaData)
+		if !ok {
+			continue
+		}
+		hash := txm.GetHash().String()
+		query, err := NewTransactionQuery(db, map[string]string{"Hash": hash, "Full": "true"})
+		c.Assert(err, IsNil)
+		var result QueryResult
+		c.Assert(db.Query(query, &result), IsNil, Commentf(hash))
+		c.Assert(result.Transactions, HasLen, 1, Commentf(hash))
+		stored := result.Transactions[0].TransactionWithMetaData
+		c.Assert(stored.GetHash().String(), Equals, hash)
+		c.Assert(stored.MetaData.AffectedNodes, HasLen, len(txm.MetaData.AffectedNodes), Commentf(hash))
+		c.Assert(stored.GetBase().Memos, HasLen, len(txm.GetBase().Memos), Commentf(hash))
+		expected, err := rawNode(txm)
+		c.Assert(err, IsNil)
+		raw, err := rawNode(stored)
+		c.Assert(err, IsNil)
+		c.Assert(raw, DeepEquals, expected, Commentf(hash))
+	}
+}
+
+// TestTransactionsWithoutRaw rebuilds transactions stored before the Raw
+// column was added from the Memo, Path and ledger entry tables
+func (s *SqlSuite) TestTransactionsWithoutRaw(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := insertNodes(c, db)
+	_, err = db.(*sqldb).Exec(`UPDATE Transaction SET Raw=NULL;`)
+	c.Assert(err, IsNil)
+	for _, node := range nodes {
+		txm, ok := node.(*data.TransactionWithMetaData)
+		if !ok {
+			continue
+		}
+		hash := txm.GetHash().String()
+		query, err := NewTransactionQuery(db, map[string]string{"Hash": hash, "Full": "true"})
+		c.Assert(err, IsNil)
+		var result QueryResult
+		c.Assert(db.Query(query, &result), IsNil, Commentf(hash))
+		c.Assert(result.Transactions, HasLen, 1, Commentf(hash))
+		stored := result.Transactions[0].TransactionWithMetaData
+		c.Assert(stored.GetBase().Memos, HasLen, len(txm.GetBase().Memos), Commentf(hash))
+		c.Assert(stored.MetaData.AffectedNodes, HasLen, len(txm.MetaData.AffectedNodes), Commentf(hash))
+		for i, effect := range txm.MetaData.AffectedNodes {
+			expected, current, _, state := effect.AffectedNode()
+			var (
+				rebuilt = stored.MetaData.AffectedNodes[i]
+				node    *data.AffectedNode
+				fields  data.LedgerEntry
+			)
+			switch state {
+			case data.Created:
+				node = rebuilt.CreatedNode
+			case data.Deleted:
+				node = rebuilt.DeletedNode
+			default:
+				node = rebuilt.ModifiedNode
+			}
+			comment := Commentf("%s node %d", hash, i)
+			c.Assert(node, NotNil, comment)
+			c.Assert(node.LedgerEntryType, Equals, expected.LedgerEntryType, comment)
+			c.Assert(node.LedgerIndex, DeepEquals, expected.LedgerIndex, comment)
+			c.Assert(node.PreviousTxnID, DeepEquals, expected.PreviousTxnID, comment)
+			if fields = node.FinalFields; state == data.Created {
+				fields = node.NewFields
+			}
+			switch v := current.(type) {
+			case *data.AccountRoot:
+				c.Assert(fields.(*data.AccountRoot).Account, DeepEquals, v.Account, comment)
+				c.Assert(fields.(*data.AccountRoot).Sequence, DeepEquals, v.Sequence, comment)
+			case *data.Offer:
+				c.Assert(fields.(*data.Offer).Account, DeepEquals, v.Account, comment)
+				c.Assert(fields.(*data.Offer).TakerPays.String(), Equals, v.TakerPays.String(), comment)
+			case *data.RippleState:
+				c.Assert(fields.(*data.RippleState).LowLimit.String(), Equals, v.LowLimit.String(), comment)
+				c.Assert(fields.(*data.RippleState).HighLimit.String(), Equals, v.HighLimit.String(), comment)
+			}
+		}
+	}
+}
+
+func (s *SqlSuite) TestCompleteLedger(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	ledgers, txs := byLedger(insertNodes(c, db))
+	c.Assert(ledgers, Not(HasLen), 0)
+	for _, ledger := range ledgers {
+		seq := ledger.LedgerSequence
+		missing, err := db.MissingCompleteLedgers(seq, seq)
+		c.Assert(err, IsNil)
+		c.Assert(missing, DeepEquals, []uint32{seq}, Commentf("Insert must not complete %d", seq))
+		if ledger.TransactionHash != (data.Hash256{}) {
+			c.Assert(db.CompleteLedger(ledger, nil), NotNil, Commentf("Completing %d without transactions", seq))
+		}
+		if err := db.CompleteLedger(ledger, txs[seq]); err != nil {
+			// The sample transactions need not cover the whole ledger
+			continue
+		}
+		c.Assert(db.CompleteLedger(ledger, txs[seq]), IsNil, Commentf("Completing %d again", seq))
+		missing, err = db.MissingCompleteLedgers(seq, seq)
+		c.Assert(err, IsNil)
+		c.Assert(missing, HasLen, 0)
+		// Inserting a complete ledger again keeps it complete
+		c.Assert(db.Insert(ledger), IsNil)
+		c.Assert(db.InsertBatch([]data.Storer{ledger}), IsNil)
+		missing, err = db.MissingCompleteLedgers(seq, seq)
+		c.Assert(err, IsNil)
+		c.Assert(missing, HasLen, 0, Commentf("Inserting %d again", seq))
+	}
+}
+
+func (s *SqlSuite) TestForks(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	ledgers, txs := byLedger(insertNodes(c, db))
+	c.Assert(ledgers, Not(HasLen), 0)
+	ledger := ledgers[0]
+	seq, orphan := ledger.LedgerSequence, *ledger.GetHash()
+	forked := *ledger
+	forked.GetHash()[0] ^= 1
+	c.Assert(db.Insert(&forked), IsNil)
+	conflicts, err := db.LedgerConflicts(seq, seq)
+	c.Assert(err, IsNil)
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].Hash, Equals, *forked.GetHash())
+	c.Assert(conflicts[0].OrphanHash, Equals, orphan)
+	var n int
+	c.Assert(db.(*sqldb).QueryRow(`SELECT COUNT(*) FROM OrphanLedger WHERE Hash=? AND Raw IS NOT NULL;`, orphan.Bytes()).Scan(&n), IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(db.(*sqldb).QueryRow(`SELECT COUNT(*) FROM OrphanTransaction WHERE LedgerHash=? AND Raw IS NOT NULL;`, orphan.Bytes()).Scan(&n), IsNil)
+	c.Assert(n, Equals, len(txs[seq]))
+	for _, t := range txs[seq] {
+		_, err := db.Get(*t.GetHash())
+		c.Assert(err, NotNil, Commentf("%s was not orphaned", t.GetHash()))
+	}
+
+	// InsertBatch replaces the fork before writing the transactions
+	var items []data.Storer
+	for _, t := range txs[seq] {
+		items = append(items, t)
+	}
+	c.Assert(db.InsertBatch(append(items, ledger)), IsNil)
+	conflicts, err = db.LedgerConflicts(seq, seq)
+	c.Assert(err, IsNil)
+	c.Assert(conflicts, HasLen, 2)
+	for _, t := range txs[seq] {
+		_, err := db.Get(*t.GetHash())
+		c.Assert(err, IsNil, Commentf(t.GetHash().String()))
+	}
+
+	// A transaction cannot be added to a complete ledger
+	for _, ledger := range ledgers {
+		seq := ledger.LedgerSequence
+		if len(txs[seq]) == 0 || db.CompleteLedger(ledger, txs[seq]) != nil {
+			continue
+		}
+		t := txs[seq][0]
+		t.GetHash()[0] ^= 1
+		c.Assert(db.Insert(t), NotNil, Commentf("Adding %s to %d", t.GetHash(), seq))
+	}
+}
+
+func (s *SqlSuite) TestPruner(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := insertNodes(c, db)
+	ledgers, _ := byLedger(nodes)
+	var first, last uint32
+	for _, ledger := range ledgers {
+		if seq := ledger.LedgerSequence; first == 0 || seq < first {
+			first = seq
+		}
+		if seq := ledger.LedgerSequence; seq > last {
+			last = seq
+		}
+	}
+	c.Assert(last > first, Equals, true)
+	_, err = NewPruner(db, RetentionPolicy{})
+	c.Assert(err, NotNil)
+	p, err := NewPruner(db, RetentionPolicy{Ledgers: last - first})
+	c.Assert(err, IsNil)
+	horizon, err := p.Horizon()
+	c.Assert(err, IsNil)
+	c.Assert(horizon, Equals, first+1)
+	// As though a prune had stopped after moving PrunedBefore
+	_, err = db.(*sqldb).Exec(statements["UpdatePrunedBefore"], horizon)
+	c.Assert(err, IsNil)
+	missing, err := db.MissingLedgers(first, first)
+	c.Assert(err, IsNil)
+	c.Assert(missing, HasLen, 0)
+	c.Assert(p.Prune(), IsNil)
+	prunedBefore, err := db.(*sqldb).PrunedBefore()
+	c.Assert(err, IsNil)
+	c.Assert(prunedBefore, Equals, horizon)
+	missing, err = db.MissingLedgers(first, first)
+	c.Assert(err, IsNil)
+	c.Assert(missing, HasLen, 0)
+	for _, node := range nodes {
+		hash := *node.GetHash()
+		_, err := db.Get(hash)
+		if seq := ledgerSequence(node); seq < horizon {
+			c.Assert(err, Equals, storage.ErrNotFound, Commentf(hash.String()))
+		} else {
+			c.Assert(err, IsNil, Commentf(hash.String()))
+		}
+	}
+
+	// The sample ledgers are all older than an hour
+	p, err = NewPruner(db, RetentionPolicy{MaxAge: time.Hour, Interval: time.Millisecond})
+	c.Assert(err, IsNil)
+	horizon, err = p.Horizon()
+	c.Assert(err, IsNil)
+	c.Assert(horizon, Equals, last+1)
+	p.Start()
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(p.Stop(), IsNil)
+	c.Assert(p.Stop(), IsNil)
+	for _, node := range nodes {
+		_, err := db.Get(*node.GetHash())
+		c.Assert(err, Equals, storage.ErrNotFound, Commentf(node.GetHash().String()))
+	}
+}
+
+func (s *SqlSuite) TestPartitions(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	inner := db.(*sqldb)
+	c.Assert(inner.EnablePartitioning(1000), IsNil)
+	_, err = inner.Exec(`ALTER TABLE Memo ADD PARTITION (PARTITION pmax VALUES LESS THAN MAXVALUE);`)
+	c.Assert(err, IsNil)
+	inner.partitionMu.Lock()
+	err = inner.loadPartitions()
+	inner.partitionMu.Unlock()
+	c.Assert(err, IsNil)
+	c.Assert(inner.partitionBounds["Memo"], Equals, uint64(2000))
+	c.Assert(inner.partitionsNeeded(999), Equals, false)
+	c.Assert(inner.partitionsNeeded(1000), Equals, true)
+	c.Assert(inner.ensurePartitions(1000), IsNil)
+	for _, table := range ledgerTables {
+		c.Assert(inner.partitionBounds[table], Equals, uint64(1000+partitionsAhead*1000+1000), Commentf(table))
+	}
+	c.Assert(inner.partitionsNeeded(1000+(partitionsAhead-1)*1000-1), Equals, false)
+	partitions, err := inner.partitions("Memo")
+	c.Assert(err, IsNil)
+	last := partitions[len(partitions)-1]
+	c.Assert(last.Name, Equals, "pmax")
+	c.Assert(last.MaxValue, Equals, true)
+	c.Assert(last.Lower, Equals, inner.partitionBounds["Memo"])
+}
+
+func (s *SqlSuite) TestMigrations(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	status, err := db.SchemaStatus()
+	c.Assert(err, IsNil)
+	c.Assert(status.Version, Equals, latestVersion())
+	c.Assert(status.Pending, HasLen, 0)
+	// As though the last migration failed partway
+	_, err = db.(*sqldb).Exec(`DELETE FROM SchemaVersion WHERE Version=?;`, latestVersion())
+	c.Assert(err, IsNil)
+	_, err = NewMySqlDBWithOptions(Options{DSN: *connectionstring})
+	c.Assert(err, ErrorMatches, ".*run Migrate.*")
+	migrated, err := NewMySqlDBWithOptions(Options{DSN: *connectionstring, Migrate: true})
+	c.Assert(err, IsNil)
+	status, err = migrated.SchemaStatus()
+	c.Assert(err, IsNil)
+	c.Assert(status.Version, Equals, latestVersion())
+	c.Assert(status.Pending, HasLen, 0)
+	// NewMySqlDB migrates, as it created the schema before migrations
+	_, err = db.(*sqldb).Exec(`DELETE FROM SchemaVersion WHERE Version=?;`, latestVersion())
+	c.Assert(err, IsNil)
+	migrated, err = NewMySqlDB(*connectionstring, false)
+	c.Assert(err, IsNil)
+	status, err = migrated.SchemaStatus()
+	c.Assert(err, IsNil)
+	c.Assert(status.Pending, HasLen, 0)
+	_, err = db.(*sqldb).Exec(`INSERT INTO SchemaVersion VALUES(?,'Future',NOW());`, latestVersion()+1)
+	c.Assert(err, IsNil)
+	_, err = NewMySqlDBWithOptions(Options{DSN: *connectionstring, ReadOnly: true})
+	c.Assert(err, ErrorMatches, ".*newer than supported.*")
+}
+
+func (s *SqlSuite) TestPrefixTables(c *C) {
+	tables := map[string]bool{"Account": true, "Ledger": true, "Transaction": true}
+	for query, expected := range map[string]string{
+		"SELECT Id FROM Account WHERE Account=?;":                                  "SELECT Id FROM p_Account WHERE Account=?;",
+		"INSERT INTO Account SELECT MAX(Id)+1,? FROM Account;":                     "INSERT INTO p_Account SELECT MAX(Id)+1,? FROM p_Account;",
+		"CREATE TABLE IF NOT EXISTS archive.Ledger LIKE Ledger;":                   "CREATE TABLE IF NOT EXISTS archive.p_Ledger LIKE p_Ledger;",
+		"SELECT t.Account FROM Ledger l JOIN Transaction t ON Ledger.Hash=?;":      "SELECT t.Account FROM p_Ledger l JOIN p_Transaction t ON p_Ledger.Hash=?;",
+		"SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_NAME='Ledger'": "SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_NAME='Ledger'",
+		"LOAD DATA LOCAL INFILE 'Reader::Ledger' INTO TABLE Ledger;":               "LOAD DATA LOCAL INFILE 'Reader::Ledger' INTO TABLE p_Ledger;",
+	} {
+		c.Assert(prefixTables(query, "p_", tables), Equals, expected)
+	}
+}
+
+func (s *SqlSuite) TestReset(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	inner := db.(*sqldb)
+	count := func(table string) (n int) {
+		c.Assert(inner.QueryRow(`SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=?;`, table).Scan(&n), IsNil)
+		return n
+	}
+	c.Assert(count(markerTable), Equals, 1)
+	nodes := insertNodes(c, db)
+
+	// Prefixed archives share the database and reset on their own
+	prefixed, err := NewMySqlDBWithOptions(Options{DSN: *connectionstring, TablePrefix: "p_", Reset: true})
+	c.Assert(err, IsNil)
+	c.Assert(count("p_"+markerTable), Equals, 1)
+	c.Assert(count("p_Ledger"), Equals, 1)
+	insertNodes(c, prefixed)
+	for _, node := range nodes {
+		_, err := prefixed.Get(*node.GetHash())
+		c.Assert(err, IsNil, Commentf(node.GetHash().String()))
+	}
+	_, err = NewMySqlDBWithOptions(Options{DSN: *connectionstring, TablePrefix: "p_", Reset: true})
+	c.Assert(err, IsNil)
+	for _, node := range nodes {
+		_, err := db.Get(*node.GetHash())
+		c.Assert(err, IsNil, Commentf(node.GetHash().String()))
+	}
+
+	// Tables not created by this package are never dropped
+	_, err = inner.Exec(`CREATE TABLE q_Ledger (LedgerSequence INT UNSIGNED NOT NULL);`)
+	c.Assert(err, IsNil)
+	defer inner.Exec(`DROP TABLE q_Ledger;`)
+	_, err = NewMySqlDBWithOptions(Options{DSN: *connectionstring, TablePrefix: "q_", Reset: true})
+	c.Assert(err, ErrorMatches, "Refusing to drop.*")
+	c.Assert(count("q_Ledger"), Equals, 1)
+
+	// Opening an existing database never adds the marker
+	_, err = inner.Exec(`DROP TABLE ` + markerTable + `;`)
+	c.Assert(err, IsNil)
+	defer inner.Exec(`CREATE TABLE ` + markerTable + ` (Created DATETIME NOT NULL);`)
+	_, err = NewMySqlDB(*connectionstring, false)
+	c.Assert(err, IsNil)
+	c.Assert(count(markerTable), Equals, 0)
+	_, err = NewMySqlDB(*connectionstring, true)
+	c.Assert(err, ErrorMatches, "Refusing to drop.*")
+}
+
+func (s *SqlSuite) TestReplicas(c *C) {
+	_, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	db, err := NewMySqlDBWithOptions(Options{
+		DSN:           *connectionstring,
+		Replicas:      []string{*connectionstring, "nobody:nobody@tcp(127.0.0.1:1)/rippletest"},
+		MaxReplicaLag: 10,
+		ReplicaLagTTL: time.Hour,
+	})
+	c.Assert(err, IsNil)
+	inner := db.(*sqldb)
+	c.Assert(inner.reader(), Equals, inner.replicas[0].DB)
+	checked := inner.replicas[0].checked
+	c.Assert(checked.IsZero(), Equals, false)
+	for i := 0; i < 4; i++ {
+		c.Assert(inner.reader(), Equals, inner.replicas[0].DB)
+	}
+	c.Assert(inner.replicas[0].checked, Equals, checked)
+	c.Assert(inner.replicas[0].errors, Equals, uint64(0))
+	c.Assert(inner.replicas[1].errors, Equals, uint64(1))
+	c.Assert(db.Stats(), Matches, "Replica 1: 1 errors, last: .*")
+}
+
+func (s *SqlSuite) TestCancelledReads(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := insertNodes(c, db)
+	min, max := ledgerRange(nodes)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.PrunedBeforeContext(ctx)
+	c.Assert(err, Equals, context.Canceled)
+	_, err = db.MissingLedgersContext(ctx, min, max)
+	c.Assert(err, Equals, context.Canceled)
+	_, err = db.SearchAccountsContext(ctx, "r")
+	c.Assert(err, Equals, context.Canceled)
+	_, err = db.MissingLedgersContext(context.Background(), min, max)
+	c.Assert(err, IsNil)
+}
+
+func (s *SqlSuite) TestDuplicateLookups(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	inner := db.(*sqldb)
+	for _, stmnt := range []string{
+		`ALTER TABLE Account DROP INDEX Account;`,
+		`INSERT INTO Account VALUES(1000,REPEAT('a',20),'dup'),(1001,REPEAT('a',20),'dup');`,
+		`DELETE FROM SchemaVersion WHERE Version>=4;`,
+	} {
+		_, err := inner.Exec(stmnt)
+		c.Assert(err, IsNil, Commentf(stmnt))
+	}
+	c.Assert(db.Migrate(), ErrorMatches, "Migration 4: 1 values of Account are stored more than once, for example Ids 1000 and 1001.*")
+	status, err := db.SchemaStatus()
+	c.Assert(err, IsNil)
+	c.Assert(status.Version, Equals, uint32(2))
+	_, err = inner.Exec(`DELETE FROM Account WHERE Id=1001;`)
+	c.Assert(err, IsNil)
+	c.Assert(db.Migrate(), IsNil)
+	status, err = db.SchemaStatus()
+	c.Assert(err, IsNil)
+	c.Assert(status.Pending, HasLen, 0)
+}
+
+func (s *SqlSuite) TestLookupRollback(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	inner := db.(*sqldb)
+	var account data.Account
+	account[0] = 1
+	tx, err := inner.Begin()
+	c.Assert(err, IsNil)
+	lookups := inner.lookupTx(tx)
+	_, err = lookups.LookupAccount(&account)
+	c.Assert(err, IsNil)
+	_, ok := inner.accounts.cache.id(account)
+	c.Assert(ok, Equals, false)
+	failed := fmt.Errorf("failed")
+	c.Assert(lookups.rollback(failed), Equals, failed)
+	c.Assert(lookups.accounts, HasLen, 0)
+	_, ok = inner.accounts.cache.id(account)
+	c.Assert(ok, Equals, false)
+	// The row went with the transaction
+	err = db.GetLookupId("GetAccountId", &LookupItem{Value: account[:]})
+	c.Assert(err, Equals, storage.ErrNotFound)
+	tx, err = inner.Begin()
+	c.Assert(err, IsNil)
+	lookups = inner.lookupTx(tx)
+	id, err := lookups.LookupAccount(&account)
+	c.Assert(err, IsNil)
+	c.Assert(lookups.commit(), IsNil)
+	cached, ok := inner.accounts.cache.id(account)
+	c.Assert(ok, Equals, true)
+	c.Assert(cached, Equals, id)
+}
+
+// ingestJobs sends empty jobs for ledgers first to last, failing at fail
+func ingestJobs(first, last, fail uint32) (<-chan IngestJob, <-chan struct{}) {
+	jobs, done := make(chan IngestJob), make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(jobs)
+		for seq := first; seq <= last; seq++ {
+			seq := seq
+			jobs <- IngestJob{LedgerSequence: seq, Load: func() ([]data.Storer, error) {
+				// Later ledgers finish loading first
+				time.Sleep(time.Duration(last-seq) * time.Millisecond)
+				if seq == fail {
+					return nil, fmt.Errorf("Cannot load %d", seq)
+				}
+				return nil, nil
+			}}
+		}
+	}()
+	return jobs, done
+}
+
+func (s *SqlSuite) TestIngester(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	ingester, err := NewIngester(db, "test", 4)
+	c.Assert(err, IsNil)
+	jobs, done := ingestJobs(1, 20, 0)
+	c.Assert(ingester.Run(1, jobs), IsNil)
+	<-done
+	checkpoint, err := ingester.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(checkpoint, Equals, uint32(20))
+
+	// A restart is handed the whole stream again
+	jobs, done = ingestJobs(1, 30, 0)
+	c.Assert(ingester.Run(checkpoint+1, jobs), IsNil)
+	<-done
+	checkpoint, err = ingester.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(checkpoint, Equals, uint32(30))
+
+	// Nothing after a failed ledger is committed and the producer is
+	// not left blocked
+	jobs, done = ingestJobs(31, 100, 40)
+	c.Assert(ingester.Run(31, jobs), ErrorMatches, "Cannot load 40")
+	<-done
+	checkpoint, err = ingester.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(checkpoint, Equals, uint32(39))
+
+	jobs, done = ingestJobs(41, 50, 0)
+	c.Assert(ingester.Run(40, jobs), ErrorMatches, "Expected ledger 40, got 41")
+	<-done
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jobs, done = ingestJobs(40, 50, 0)
+	c.Assert(ingester.RunContext(ctx, 40, jobs), Equals, context.Canceled)
+	<-done
+}
+
+// ledgerRange returns the lowest and highest ledger in nodes
+func ledgerRange(nodes []data.Storer) (uint32, uint32) {
+	var min, max uint32
+	for _, node := range nodes {
+		if seq := ledgerSequence(node); min == 0 || seq < min {
+			min = seq
+		}
+		if seq := ledgerSequence(node); seq > max {
+			max = seq
+		}
+	}
+	return min, max
+}
+
+func (s *SqlSuite) TestBulkLoader(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := readNodes(c)
+	min, max := ledgerRange(nodes)
+	c.Assert(db.InsertBatch(nodes), IsNil)
+	expected, err := db.MissingCompleteLedgers(min, max)
+	c.Assert(err, IsNil)
+
+	db, err = NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	loader, err := NewBulkLoader(db)
+	c.Assert(err, IsNil)
+	// Flush after every row, with each ledger after its transactions
+	loader.flushSize = 1
+	for i := len(nodes) - 1; i >= 0; i-- {
+		c.Assert(loader.Insert(nodes[i]), IsNil)
+	}
+	c.Assert(loader.Close(), IsNil)
+	missing, err := db.MissingCompleteLedgers(min, max)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, expected)
+	for _, node := range nodes {
+		stored, err := db.Get(*node.GetHash())
+		c.Assert(err, IsNil)
+		c.Assert(stored.GetHash().String(), Equals, node.GetHash().String())
+	}
+	result, err := loader.Exec(statements["InsertMemo"], 1, 2, 3, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(result, NotNil)
+}
+
+func (s *SqlSuite) TestTransactionHandler(c *C) {
+	nodes := readNodes(c)
+	_, txs := byLedger(nodes)
+	sequences := make(map[string]uint32)
+	var typ data.TransactionType
+	for _, ledgerTxs := range txs {
+		for _, t := range ledgerTxs {
+			if len(sequences) == 0 {
+				typ = t.GetTransactionType()
+			}
+			if t.GetTransactionType() == typ {
+				sequences[t.GetHash().String()] = t.GetBase().Sequence
+			}
+		}
+	}
+	c.Assert(sequences, Not(HasLen), 0)
+
+	// Replace the built in handler of typ with one stored elsewhere
+	builtin, tables, keys := transactionHandlers[typ], ledgerTables, primaryKeys
+	primaryKeys = make(map[string]int)
+	for table, n := range keys {
+		primaryKeys[table] = n
+	}
+	delete(transactionHandlers, typ)
+	defer func() {
+		transactionHandlers[typ], ledgerTables, primaryKeys = builtin, tables, keys
+	}()
+	c.Assert(RegisterTransactionHandler(&TransactionHandler{
+		Type:       typ,
+		Tables:     []string{"ExternalSequence"},
+		KeyColumns: []int{3},
+		Schema: []string{`
+CREATE TABLE IF NOT EXISTS ExternalSequence (
+  LedgerSequence INT UNSIGNED NOT NULL,
+  TransactionIndex INT UNSIGNED NOT NULL,
+  Sequence INT UNSIGNED NOT NULL,
+  PRIMARY KEY(LedgerSequence,TransactionIndex,Sequence)
+);`, `
+CREATE OR REPLACE VIEW ExternalSequenceView AS
+SELECT t.*,e.Sequence FROM TransactionView t
+INNER JOIN ExternalSequence e ON t.LedgerSequence=e.LedgerSequence AND t.TransactionIndex=e.TransactionIndex
+`},
+		View: "ExternalSequenceView",
+		Insert: func(t *data.TransactionWithMetaData, tx Execer, lookups Lookuper) error {
+			_, err := tx.Exec(`REPLACE INTO ExternalSequence VALUES(?,?,?);`, t.LedgerSequence, t.MetaData.TransactionIndex, t.GetBase().Sequence)
+			return err
+		},
+		Columns: func(t *TransactionRow) []interface{} {
+			return []interface{}{&t.GetBase().Sequence}
+		},
+	}), IsNil)
+
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	insertNodes(c, db)
+	count := func() (n int) {
+		c.Assert(db.(*sqldb).QueryRow(`SELECT COUNT(*) FROM ExternalSequence;`).Scan(&n), IsNil)
+		return
+	}
+	c.Assert(count(), Equals, len(sequences))
+
+	// Conflicts are found by the key columns the handler gave
+	db.SetInsertMode(InsertDetectConflicts)
+	for _, node := range nodes {
+		c.Assert(db.Insert(node), IsNil, Commentf("Reinserting %s", node.GetHash()))
+	}
+
+	query, err := NewTransactionQuery(db, map[string]string{"TransactionType": typ.String()})
+	c.Assert(err, IsNil)
+	_, err = NewTransactionQuery(db, map[string]string{"TransactionType": "Paymnt"})
+	c.Assert(err, ErrorMatches, "Unknown Transaction type: Paymnt")
+	var result QueryResult
+	c.Assert(db.Query(query, &result), IsNil)
+	c.Assert(result.Transactions, HasLen, len(sequences))
+	for _, t := range result.Transactions {
+		sequence, ok := sequences[t.GetHash().String()]
+		c.Assert(ok, Equals, true, Commentf(t.GetHash().String()))
+		c.Assert(t.GetBase().Sequence, Equals, sequence)
+	}
+
+	p, err := NewPruner(db, RetentionPolicy{MaxAge: time.Hour})
+	c.Assert(err, IsNil)
+	c.Assert(p.Prune(), IsNil)
+	c.Assert(count(), Equals, 0)
+}
+
+func (s *SqlSuite) TestLedgerEntryTables(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	inner := db.(*sqldb)
+	txm := &data.TransactionWithMetaData{Transaction: &data.Payment{}, LedgerSequence: 7}
+	txm.MetaData.TransactionIndex = 3
+	var one, two data.Hash256
+	one[0], two[0] = 1, 2
+	first, last, previousLast := uint32(5), uint32(6), uint32(5)
+	amendments := &data.Amendments{Amendments: []data.Hash256{one, two}}
+	hashes := &data.LedgerHashes{FirstLedgerSequence: &first, LastLedgerSequence: &last, Hashes: []data.Hash256{one, two}}
+	previous := &data.LedgerHashes{FirstLedgerSequence: &first, LastLedgerSequence: &previousLast, Hashes: []data.Hash256{one}}
+	tx, err := inner.Begin()
+	c.Assert(err, IsNil)
+	c.Assert(insertLedgerEntry(0, txm, data.AMENDMENTS, amendments, nil, tx, nil), IsNil)
+	c.Assert(insertLedgerEntry(1, txm, data.LEDGER_HASHES, hashes, previous, tx, nil), IsNil)
+	c.Assert(tx.Commit(), IsNil)
+
+	var (
+		stored, storedPrevious []byte
+		flags                  uint32
+		previousFlags          *uint32
+	)
+	err = inner.QueryRow(`SELECT Flags,Amendments,Previous_Flags,Previous_Amendments FROM Amendments WHERE LedgerSequence=7 AND TransactionIndex=3 AND Position=0;`).Scan(&flags, &stored, &previousFlags, &storedPrevious)
+	c.Assert(err, IsNil)
+	c.Assert(flags, Equals, uint32(0))
+	c.Assert(stored, DeepEquals, append(one[:], two[:]...))
+	c.Assert(previousFlags, IsNil)
+	c.Assert(storedPrevious, IsNil)
+
+	var storedFirst, storedLast, storedPreviousLast uint32
+	err = inner.QueryRow(`SELECT FirstLedgerSequence,LastLedgerSequence,Hashes,Previous_LastLedgerSequence,Previous_Hashes FROM LedgerHashes WHERE LedgerSequence=7 AND TransactionIndex=3 AND Position=1;`).Scan(&storedFirst, &storedLast, &stored, &storedPreviousLast, &storedPrevious)
+	c.Assert(err, IsNil)
+	c.Assert(storedFirst, Equals, first)
+	c.Assert(storedLast, Equals, last)
+	c.Assert(stored, DeepEquals, append(one[:], two[:]...))
+	c.Assert(storedPreviousLast, Equals, previousLast)
+	c.Assert(storedPrevious, DeepEquals, one[:])
+}
+
+func (s *SqlSuite) TestInsertModes(c *C) {
+	db, err := NewMySqlDB(*connectionstring, true)
+	c.Assert(err, IsNil)
+	nodes := insertNodes(c, db)
+	var txm *data.TransactionWithMetaData
+	for _, node := range nodes {
+		if t, ok := node.(*data.TransactionWithMetaData); ok {
+			txm = t
+		}
+	}
+	c.Assert(txm, NotNil)
+	// Completing a ledger does not make its next insert a conflict
+	ledgers, txs := byLedger(nodes)
+	for _, ledger := range ledgers {
+		db.CompleteLedger(ledger, txs[ledger.LedgerSequence])
+	}
+	db.SetInsertMode(InsertDetectConflicts)
+	for _, node := range nodes {
+		c.Assert(db.Insert(node), IsNil, Commentf("Reinserting %s", node.GetHash()))
+	}
+	changed := *txm
+	changed.MetaData.TransactionResult++
+	err = db.Insert(&changed)
+	conflict, ok := err.(*ConflictError)
+	c.Assert(ok, Equals, true, Commentf("%v", err))
+	c.Assert(conflict.Table, Equals, "Transaction")
+	c.Assert(conflict.LedgerSequence, Equals, txm.LedgerSequence)
+	c.Assert(*conflict.TransactionIndex, Equals, txm.MetaData.TransactionIndex)
+	c.Assert(conflict.Columns, DeepEquals, []string{"TransactionResult"})
+	db.SetInsertMode(InsertRecordConflicts)
+	c.Assert(db.Insert(&changed), IsNil)
+	stored, err := db.Get(*txm.GetHash())
+	c.Assert(err, IsNil)
+	c.Assert(stored.(*data.TransactionWithMetaData).MetaData.TransactionResult, Equals, txm.MetaData.TransactionResult)
+}
+
+func (s *SqlSuite) TestSameValue(c *C) {
+	t := time.Date(2015, 6, 1, 12, 30, 15, 400000000, time.UTC)
+	for _, stored := range []interface{}{
+		time.Date(2015, 6, 1, 12, 30, 15, 0, time.UTC),
+		[]byte("2015-06-01 12:30:15"),
+	} {
+		value, err := fieldText(t)
+		c.Assert(err, IsNil)
+		same, err := sameValue(t, value, stored)
+		c.Assert(err, IsNil)
+		c.Assert(same, Equals, true, Commentf("%v", stored))
+		same, err = sameValue(t.Add(time.Second), value, stored)
+		c.Assert(err, IsNil)
+		c.Assert(same, Equals, false, Commentf("%v", stored))
+	}
+	same, err := sameValue(uint32(7), []byte("7"), int64(7))
+	c.Assert(err, IsNil)
+	c.Assert(same, Equals, true)
+}
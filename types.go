@@ -59,7 +59,7 @@ func NewAmount(a *data.Amount) *Amount {
 	return &Amount{Amount: a}
 }
 
-func (a *Amount) Lookup(db IndexedDB) error {
+func (a *Amount) Lookup(db Lookuper) error {
 	if a.Amount == nil {
 		return nil
 	}
@@ -87,22 +87,22 @@ type Hash256 struct {
 
 type Account struct {
 	*data.Account
-	DB IndexedDB
+	DB Lookuper
 }
 
 type Currency struct {
 	*data.Currency
-	DB IndexedDB
+	DB Lookuper
 }
 
 type RegularKey struct {
 	*data.RegularKey
-	DB IndexedDB
+	DB Lookuper
 }
 
 type PublicKey struct {
 	*data.PublicKey
-	DB IndexedDB
+	DB Lookuper
 }
 
 type NullAmount struct {
@@ -193,7 +193,7 @@ func (a *Account) Scan(src interface{}) error {
 
 func (a *Account) Value() (driver.Value, error) {
 	if a.DB == nil {
-		return nil, fmt.Errorf("Need an IndexedDB")
+		return nil, fmt.Errorf("Need a Lookuper")
 	}
 	if a.Account == nil {
 		return nil, nil
@@ -207,7 +207,7 @@ func (a *Account) Value() (driver.Value, error) {
 
 func (c *Currency) Value() (driver.Value, error) {
 	if c.DB == nil {
-		return nil, fmt.Errorf("Need an IndexedDB")
+		return nil, fmt.Errorf("Need a Lookuper")
 	}
 	if c.Currency == nil {
 		return nil, nil
@@ -221,7 +221,7 @@ func (c *Currency) Value() (driver.Value, error) {
 
 func (r *RegularKey) Value() (driver.Value, error) {
 	if r.DB == nil {
-		return nil, fmt.Errorf("Need an IndexedDB")
+		return nil, fmt.Errorf("Need a Lookuper")
 	}
 	if r.RegularKey == nil {
 		return nil, nil
@@ -242,7 +242,7 @@ func (a *PublicKey) Scan(src interface{}) error {
 
 func (p *PublicKey) Value() (driver.Value, error) {
 	if p.DB == nil {
-		return nil, fmt.Errorf("Need an IndexedDB")
+		return nil, fmt.Errorf("Need a Lookuper")
 	}
 	if p.PublicKey == nil {
 		return nil, nil
@@ -350,6 +350,106 @@ func (n NullUint32) Scan(src interface{}) error {
 	return nil
 }
 
+func (c *Currency) Scan(src interface{}) error {
+	if src == nil {
+		return nil
+	}
+	return scanBytes(c.Currency[:], src, "Currency")
+}
+
+// NullUint scans a nullable unsigned column into a pointer to an
+// unsigned integer type, such as **uint32 or **data.LedgerEntryFlag
+type NullUint struct {
+	Uint interface{}
+}
+
+func (n NullUint) Scan(src interface{}) error {
+	var u uint64
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case int64:
+		u = uint64(v)
+	case uint64:
+		u = v
+	default:
+		return fmt.Errorf("NullUint: Cannot scan: %+v", src)
+	}
+	dest := reflect.ValueOf(n.Uint).Elem()
+	value := reflect.New(dest.Type().Elem())
+	value.Elem().SetUint(u)
+	dest.Set(value)
+	return nil
+}
+
+// NullBytes scans a nullable binary column into a pointer to a fixed
+// size array or byte slice type, such as **data.Hash256
+type NullBytes struct {
+	Bytes interface{}
+}
+
+func (n NullBytes) Scan(src interface{}) error {
+	if src == nil {
+		return nil
+	}
+	b, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("Cannot scan %+v into a NullBytes", src)
+	}
+	dest := reflect.ValueOf(n.Bytes).Elem()
+	value := reflect.New(dest.Type().Elem())
+	if value.Elem().Kind() == reflect.Array {
+		reflect.Copy(value.Elem(), reflect.ValueOf(b))
+	} else {
+		value.Elem().SetBytes(append([]byte(nil), b...))
+	}
+	dest.Set(value)
+	return nil
+}
+
+type NullValue struct {
+	Value **data.Value
+}
+
+func (v NullValue) Scan(src interface{}) error {
+	if src == nil {
+		return nil
+	}
+	value := new(data.Value)
+	if err := (&Value{value}).Scan(src); err != nil {
+		return err
+	}
+	*v.Value = value
+	return nil
+}
+
+// newAmount rebuilds an amount stored as value, currency and issuer
+// columns, returning nil when the value is NULL
+func newAmount(value, currency, issuer []byte) (*data.Amount, error) {
+	if value == nil {
+		return nil, nil
+	}
+	amount := &data.Amount{Value: new(data.Value)}
+	if err := amount.Value.Unmarshal(bytes.NewReader(value)); err != nil {
+		return nil, err
+	}
+	copy(amount.Currency[:], currency)
+	copy(amount.Issuer[:], issuer)
+	return amount, nil
+}
+
+// splitHashes splits concatenated hashes, the inverse of hashesBytes
+func splitHashes(b []byte) []data.Hash256 {
+	if b == nil {
+		return nil
+	}
+	hashes := make([]data.Hash256, len(b)/len(data.Hash256{}))
+	for i := range hashes {
+		copy(hashes[i][:], b[i*len(data.Hash256{}):])
+	}
+	return hashes
+}
+
 func scanBytes(dest []byte, src interface{}, typ string) error {
 	b, ok := src.([]byte)
 	if !ok {